@@ -0,0 +1,382 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitAlgorithm is an algorithm that computes a concurrency limit from
+// observed latency and error feedback.
+//
+// Implementations do not need to be safe for concurrent use; an
+// AdaptiveLimiter serializes all calls to its algorithm.
+type LimitAlgorithm interface {
+	// Limit returns the current concurrency limit.
+	Limit() int64
+	// Update adjusts the limit from a single sample and returns the new
+	// limit. The parameter "rtt" is the observed round trip time,
+	// "inflight" is the number of requests in flight when the request
+	// started, and "dropped" indicates whether the request was dropped
+	// (e.g. timed out or rejected by the backend).
+	Update(rtt time.Duration, inflight int64, dropped bool) int64
+}
+
+// clampLimit returns "limit" bounded to the range [min, max].
+func clampLimit(limit float64, min, max int64) float64 {
+	return math.Max(float64(min), math.Min(float64(max), limit))
+}
+
+// AIMD is a LimitAlgorithm that increases the limit by one for each successful
+// request and multiplies the limit by a backoff ratio whenever a request is
+// dropped (additive increase, multiplicative decrease).
+type AIMD struct {
+	// limit is the current limit
+	limit float64
+	// min is the minimum limit
+	min int64
+	// max is the maximum limit
+	max int64
+	// backoff is the ratio applied to the limit when a request is dropped
+	backoff float64
+}
+
+// NewAIMD returns an initialized AIMD algorithm with the provided initial,
+// minimum and maximum limits. The parameter "backoff" is the ratio applied to
+// the limit when a request is dropped, and must be in the range (0, 1). If an
+// invalid value is provided, the value 0.9 will be used.
+func NewAIMD(initial, min, max int64, backoff float64) *AIMD {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if backoff <= 0 || backoff >= 1 {
+		backoff = 0.9
+	}
+	return &AIMD{
+		limit:   clampLimit(float64(initial), min, max),
+		min:     min,
+		max:     max,
+		backoff: backoff,
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (a *AIMD) Limit() int64 {
+	return int64(a.limit)
+}
+
+// Update adjusts the limit from a single sample and returns the new limit.
+func (a *AIMD) Update(rtt time.Duration, inflight int64, dropped bool) int64 {
+	if dropped {
+		a.limit = clampLimit(math.Floor(a.limit*a.backoff), a.min, a.max)
+	} else if float64(inflight*2) >= a.limit {
+		// only grow the limit when it is actually being used
+		a.limit = clampLimit(a.limit+1, a.min, a.max)
+	}
+	return int64(a.limit)
+}
+
+// Vegas is a LimitAlgorithm based on TCP Vegas. It estimates the queue size
+// from the difference between the minimum observed round trip time (the
+// no-load latency) and the current round trip time, and grows the limit while
+// the estimated queue is small.
+//
+// To learn more about TCP Vegas, visit:
+// https://en.wikipedia.org/wiki/TCP_Vegas
+type Vegas struct {
+	// limit is the current limit
+	limit float64
+	// min is the minimum limit
+	min int64
+	// max is the maximum limit
+	max int64
+	// rttNoLoad is the minimum round trip time observed
+	rttNoLoad time.Duration
+}
+
+// NewVegas returns an initialized Vegas algorithm with the provided initial,
+// minimum and maximum limits.
+func NewVegas(initial, min, max int64) *Vegas {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &Vegas{
+		limit: clampLimit(float64(initial), min, max),
+		min:   min,
+		max:   max,
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (v *Vegas) Limit() int64 {
+	return int64(v.limit)
+}
+
+// Update adjusts the limit from a single sample and returns the new limit.
+func (v *Vegas) Update(rtt time.Duration, inflight int64, dropped bool) int64 {
+	log := math.Max(1, math.Log10(v.limit))
+	if dropped {
+		v.limit = clampLimit(v.limit-log, v.min, v.max)
+	}
+	if rtt <= 0 {
+		return int64(v.limit)
+	}
+	if v.rttNoLoad == 0 || rtt < v.rttNoLoad {
+		v.rttNoLoad = rtt
+		return int64(v.limit)
+	}
+	if dropped {
+		return int64(v.limit)
+	}
+	if float64(inflight*2) < v.limit {
+		// the limit is not being used, don't grow it
+		return int64(v.limit)
+	}
+	queue := math.Ceil(v.limit * (1 - float64(v.rttNoLoad)/float64(rtt)))
+	alpha, beta := 3*log, 6*log
+	switch {
+	case queue <= log:
+		v.limit += beta
+	case queue < alpha:
+		v.limit += log
+	case queue > beta:
+		v.limit -= log
+	}
+	v.limit = clampLimit(v.limit, v.min, v.max)
+	return int64(v.limit)
+}
+
+// Gradient2 is a LimitAlgorithm that adjusts the limit by the gradient between
+// a long-term (exponentially smoothed) round trip time and the current round
+// trip time. When latency rises above the long-term average the limit shrinks,
+// and when latency is at or below it the limit grows by a small queue
+// allowance.
+type Gradient2 struct {
+	// limit is the current limit
+	limit float64
+	// min is the minimum limit
+	min int64
+	// max is the maximum limit
+	max int64
+	// longRtt is the exponentially smoothed long-term round trip time
+	longRtt float64
+	// window is the number of samples in the long-term average
+	window float64
+	// samples is the number of samples seen, up to window
+	samples float64
+}
+
+// NewGradient2 returns an initialized Gradient2 algorithm with the provided
+// initial, minimum and maximum limits.
+func NewGradient2(initial, min, max int64) *Gradient2 {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &Gradient2{
+		limit:  clampLimit(float64(initial), min, max),
+		min:    min,
+		max:    max,
+		window: 600,
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (g *Gradient2) Limit() int64 {
+	return int64(g.limit)
+}
+
+// Update adjusts the limit from a single sample and returns the new limit.
+func (g *Gradient2) Update(rtt time.Duration, inflight int64, dropped bool) int64 {
+	if rtt <= 0 {
+		return int64(g.limit)
+	}
+	short := float64(rtt)
+	// update the long-term average, using a plain average until the
+	// window has filled up
+	if g.samples < g.window {
+		g.samples++
+	}
+	g.longRtt += (short - g.longRtt) / g.samples
+	// decay the long-term average quickly when latency has recovered, so
+	// the limit can grow again
+	if g.longRtt/short > 2 {
+		g.longRtt *= 0.95
+	}
+	if !dropped && float64(inflight*2) < g.limit {
+		// the limit is not being used, don't adjust it
+		return int64(g.limit)
+	}
+	gradient := math.Max(0.5, math.Min(1, 1.5*g.longRtt/short))
+	if dropped {
+		gradient = 0.5
+	}
+	queue := math.Sqrt(g.limit)
+	limit := g.limit*gradient + queue
+	// smooth the change to avoid oscillation
+	g.limit = clampLimit(g.limit*0.8+limit*0.2, g.min, g.max)
+	return int64(g.limit)
+}
+
+// AdaptiveLimiter limits the number of concurrent requests to a limit that is
+// continuously adjusted by a LimitAlgorithm from the latency and error
+// feedback of completed requests.
+type AdaptiveLimiter struct {
+	// alg is the algorithm that computes the limit
+	alg LimitAlgorithm
+	// mu is the mutex for accessing alg and inflight
+	mu sync.Mutex
+	// inflight is the number of requests currently in flight
+	inflight int64
+	// closed indicates whether the limiter is closed (1) or not (0)
+	closed uint32
+}
+
+// NewAdaptiveLimiter returns an initialized AdaptiveLimiter pointer that uses
+// the provided algorithm to compute its limit.
+func NewAdaptiveLimiter(alg LimitAlgorithm) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		alg: alg,
+	}
+}
+
+// Acquire attempts to start a new request.
+//
+// It returns a token and true if the request may proceed, or nil and false if
+// the limit has been reached or the limiter is closed. Exactly one of the
+// token's OnSuccess, OnDropped or OnIgnore functions must be called once the
+// request completes.
+func (al *AdaptiveLimiter) Acquire() (*AdaptiveToken, bool) {
+	if al.IsClosed() {
+		return nil, false
+	}
+	al.mu.Lock()
+	if al.inflight >= al.alg.Limit() {
+		al.mu.Unlock()
+		return nil, false
+	}
+	al.inflight += 1
+	tok := &AdaptiveToken{
+		al:       al,
+		start:    time.Now(),
+		inflight: al.inflight,
+	}
+	al.mu.Unlock()
+	return tok, true
+}
+
+// Close permanently closes the AdaptiveLimiter. Subsequent calls to Acquire
+// will fail, while tokens that have already been acquired may still be
+// completed.
+//
+// It returns true if the AdaptiveLimiter has been closed, or false if the
+// AdaptiveLimiter has already been closed.
+func (al *AdaptiveLimiter) Close() bool {
+	return atomic.CompareAndSwapUint32(&al.closed, 0, 1)
+}
+
+// IsClosed returns true if the AdaptiveLimiter has been closed. It returns
+// false if it is still open.
+func (al *AdaptiveLimiter) IsClosed() bool {
+	return atomic.LoadUint32(&al.closed) != 0
+}
+
+// InFlight returns the number of requests currently in flight.
+func (al *AdaptiveLimiter) InFlight() int64 {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.inflight
+}
+
+// Limit returns the current concurrency limit.
+func (al *AdaptiveLimiter) Limit() int64 {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.alg.Limit()
+}
+
+// release completes a request, feeding the sample to the algorithm if
+// "update" is true.
+func (al *AdaptiveLimiter) release(tok *AdaptiveToken, rtt time.Duration, dropped, update bool) {
+	al.mu.Lock()
+	al.inflight -= 1
+	if update {
+		al.alg.Update(rtt, tok.inflight, dropped)
+	}
+	al.mu.Unlock()
+}
+
+// AdaptiveToken represents a single request that has been admitted by an
+// AdaptiveLimiter.
+type AdaptiveToken struct {
+	// al is the limiter that issued the token
+	al *AdaptiveLimiter
+	// start is the time the token was issued
+	start time.Time
+	// inflight is the number of requests in flight when the token was issued
+	inflight int64
+	// done indicates whether the token has been completed (1) or not (0)
+	done uint32
+}
+
+// OnSuccess completes the request as successful with the provided round trip
+// time. If "rtt" is 0, the time since the token was acquired is used.
+func (tok *AdaptiveToken) OnSuccess(rtt time.Duration) {
+	if !atomic.CompareAndSwapUint32(&tok.done, 0, 1) {
+		return
+	}
+	if rtt == 0 {
+		rtt = time.Since(tok.start)
+	}
+	tok.al.release(tok, rtt, false, true)
+}
+
+// OnDropped completes the request as dropped (e.g. it timed out or was
+// rejected by the backend), which signals the algorithm to reduce the limit.
+func (tok *AdaptiveToken) OnDropped() {
+	if !atomic.CompareAndSwapUint32(&tok.done, 0, 1) {
+		return
+	}
+	tok.al.release(tok, time.Since(tok.start), true, true)
+}
+
+// OnIgnore completes the request without affecting the limit. It should be
+// used for requests that failed for reasons unrelated to load (e.g. invalid
+// input).
+func (tok *AdaptiveToken) OnIgnore() {
+	if !atomic.CompareAndSwapUint32(&tok.done, 0, 1) {
+		return
+	}
+	tok.al.release(tok, 0, false, false)
+}
@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiterAcquire(t *testing.T) {
+	al := NewAdaptiveLimiter(NewAIMD(2, 1, 10, 0.5))
+	tok1, ok1 := al.Acquire()
+	_, ok2 := al.Acquire()
+	if !ok1 || !ok2 {
+		t.Error("Acquire failed below the limit")
+	}
+	if _, ok := al.Acquire(); ok {
+		t.Error("Acquire succeeded above the limit")
+	}
+	tok1.OnIgnore()
+	tok1.OnIgnore()
+	if al.InFlight() != 1 {
+		t.Error("Completing a token twice should only release once")
+	}
+	if al.Limit() != 2 {
+		t.Error("OnIgnore should not change the limit")
+	}
+	if !al.Close() || al.Close() {
+		t.Error("Close returned an incorrect value")
+	}
+	if _, ok := al.Acquire(); ok {
+		t.Error("Acquire succeeded on closed AdaptiveLimiter")
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	a := NewAIMD(10, 2, 12, 0.5)
+	if a.Update(time.Millisecond, 10, false) != 11 {
+		t.Error("AIMD should increase the limit on success")
+	}
+	if a.Update(time.Millisecond, 1, false) != 11 {
+		t.Error("AIMD should not increase an unused limit")
+	}
+	if a.Update(time.Millisecond, 10, true) != 5 {
+		t.Error("AIMD should back off the limit on drop")
+	}
+	for i := 0; i < 5; i++ {
+		a.Update(time.Millisecond, 1, true)
+	}
+	if a.Limit() != 2 {
+		t.Error("AIMD limit should not drop below the minimum")
+	}
+}
+
+func TestVegas(t *testing.T) {
+	v := NewVegas(10, 1, 100)
+	v.Update(time.Millisecond*10, 10, false)
+	if v.Update(time.Millisecond*10, 10, false) <= 10 {
+		t.Error("Vegas should increase the limit with no queueing")
+	}
+	limit := v.Limit()
+	if v.Update(time.Millisecond*100, limit, false) >= limit {
+		t.Error("Vegas should decrease the limit with heavy queueing")
+	}
+}
+
+func TestVegasDropped(t *testing.T) {
+	v := NewVegas(10, 1, 100)
+	if v.Update(time.Millisecond*10, 10, true) >= 10 {
+		t.Error("Vegas should decrease the limit on a drop with the first sample")
+	}
+	limit := v.Limit()
+	if v.Update(time.Millisecond, limit, true) >= limit {
+		t.Error("Vegas should decrease the limit on a drop with a new minimum rtt")
+	}
+}
+
+func TestGradient2(t *testing.T) {
+	g := NewGradient2(20, 1, 100)
+	for i := 0; i < 10; i++ {
+		g.Update(time.Millisecond*10, 20, false)
+	}
+	limit := g.Limit()
+	if limit <= 20 {
+		t.Error("Gradient2 should increase the limit with stable latency")
+	}
+	for i := 0; i < 10; i++ {
+		g.Update(time.Millisecond*100, limit, false)
+	}
+	if g.Limit() >= limit {
+		t.Error("Gradient2 should decrease the limit when latency rises")
+	}
+}
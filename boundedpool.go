@@ -0,0 +1,207 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolClosed is returned when getting an item from a closed pool.
+var ErrPoolClosed = errors.New("ratelim: pool is closed")
+
+// PoolStats holds the statistics of a BoundedPool.
+type PoolStats struct {
+	// InUse is the number of items currently checked out of the pool
+	InUse int64
+	// Idle is the number of items idle in the pool
+	Idle int64
+	// Waits is the total number of Get calls that had to wait for an item
+	Waits int64
+	// WaitDuration is the total time spent waiting for items
+	WaitDuration time.Duration
+	// Created is the total number of items created
+	Created int64
+	// Destroyed is the total number of items destroyed
+	Destroyed int64
+}
+
+// BoundedPool is a pool of reusable resources (e.g. database connections)
+// with a hard limit on the total number of items, idle or in use.
+//
+// When the limit has been reached, Get blocks until an item is returned with
+// Put or Discard. Waiters are served in FIFO order.
+type BoundedPool[T any] struct {
+	// sem limits the number of items checked out of the pool
+	sem *Semaphore
+	// idle holds the idle items
+	idle *PoolOf[T]
+	// new creates an item when no idle item is available
+	new func(context.Context) (T, error)
+	// waits is the total number of Get calls that had to wait
+	waits int64
+	// waitDur is the total time spent waiting, in nanoseconds
+	waitDur int64
+	// created is the total number of items created
+	created int64
+	// destroyed is the total number of items destroyed
+	destroyed int64
+	// cch is closed when the pool is closed, waking waiting Get calls
+	cch chan struct{}
+	// closed indicates whether the pool is closed (1) or not (0)
+	closed uint32
+}
+
+// NewBoundedPool returns an initialized BoundedPool pointer that allows at most
+// "maxOpen" items to be checked out at once, keeps at most "maxIdle" idle
+// items, and uses "new" to create items. The provided hooks manage the
+// lifecycle of idle items, as they do for a PoolOf.
+//
+// If hooks.MaxIdle is set, Close must be called once the pool will no longer be
+// used.
+func NewBoundedPool[T any](maxOpen, maxIdle int64, new func(context.Context) (T, error), hooks PoolHooks[T]) *BoundedPool[T] {
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	bp := &BoundedPool[T]{
+		sem: NewSemaphore(maxOpen),
+		new: new,
+		cch: make(chan struct{}),
+	}
+	// count destroyed items, whatever the reason they were discarded
+	close := hooks.Close
+	hooks.Close = func(item T) {
+		atomic.AddInt64(&bp.destroyed, 1)
+		if close != nil {
+			close(item)
+		}
+	}
+	bp.idle = NewHookedPoolOf[T](maxIdle, nil, hooks)
+	return bp
+}
+
+// Get returns an idle item from the pool, or creates a new one. If the maximum
+// number of items are already checked out, Get blocks until one is returned or
+// the context is done.
+//
+// It returns ErrPoolClosed if the pool is closed, including while waiting,
+// ctx.Err() if the context is done first, or the error returned when creating
+// a new item.
+func (bp *BoundedPool[T]) Get(ctx context.Context) (T, error) {
+	var zero T
+	if bp.IsClosed() {
+		return zero, ErrPoolClosed
+	}
+	if !bp.sem.TryAcquire(1) {
+		atomic.AddInt64(&bp.waits, 1)
+		start := time.Now()
+		err := bp.acquire(ctx)
+		atomic.AddInt64(&bp.waitDur, int64(time.Since(start)))
+		if err != nil {
+			return zero, err
+		}
+	}
+	if v, ok := bp.idle.get(); ok {
+		return v, nil
+	}
+	v, err := bp.new(ctx)
+	if err != nil {
+		bp.sem.Release(1)
+		return zero, err
+	}
+	atomic.AddInt64(&bp.created, 1)
+	return v, nil
+}
+
+// Put returns an item obtained with Get to the pool.
+func (bp *BoundedPool[T]) Put(item T) {
+	bp.idle.Put(item)
+	bp.sem.Release(1)
+}
+
+// Discard destroys an item obtained with Get (e.g. a broken connection) instead
+// of returning it to the pool, freeing its place for a new item.
+func (bp *BoundedPool[T]) Discard(item T) {
+	bp.idle.destroy(item)
+	bp.sem.Release(1)
+}
+
+// Stats returns the current statistics of the pool.
+func (bp *BoundedPool[T]) Stats() PoolStats {
+	return PoolStats{
+		InUse:        bp.sem.InUse(),
+		Idle:         bp.idle.Len(),
+		Waits:        atomic.LoadInt64(&bp.waits),
+		WaitDuration: time.Duration(atomic.LoadInt64(&bp.waitDur)),
+		Created:      atomic.LoadInt64(&bp.created),
+		Destroyed:    atomic.LoadInt64(&bp.destroyed),
+	}
+}
+
+// Close destroys all idle items and wakes any Get calls waiting for an item.
+// Waiting and subsequent calls to Get return ErrPoolClosed, and items returned
+// with Put are destroyed.
+//
+// It returns true if the pool has been closed, or false if the pool has
+// already been closed.
+func (bp *BoundedPool[T]) Close() bool {
+	if !atomic.CompareAndSwapUint32(&bp.closed, 0, 1) {
+		return false
+	}
+	close(bp.cch)
+	bp.idle.Close()
+	return true
+}
+
+// IsClosed returns true if the pool has been closed. It returns false if it is
+// still open.
+func (bp *BoundedPool[T]) IsClosed() bool {
+	return atomic.LoadUint32(&bp.closed) != 0
+}
+
+// acquire waits for a place in the pool until the context is done or the pool
+// is closed.
+func (bp *BoundedPool[T]) acquire(ctx context.Context) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-bp.cch:
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+	if err := bp.sem.Acquire(wctx, 1); err != nil {
+		if bp.IsClosed() && ctx.Err() == nil {
+			return ErrPoolClosed
+		}
+		return err
+	}
+	if bp.IsClosed() {
+		bp.sem.Release(1)
+		return ErrPoolClosed
+	}
+	return nil
+}
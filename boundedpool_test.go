@@ -0,0 +1,105 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestBoundedPool(maxOpen, maxIdle int64) *BoundedPool[*bytes.Buffer] {
+	return NewBoundedPool(maxOpen, maxIdle, func(context.Context) (*bytes.Buffer, error) {
+		return new(bytes.Buffer), nil
+	}, PoolHooks[*bytes.Buffer]{})
+}
+
+func TestBoundedPoolGet(t *testing.T) {
+	bp := newTestBoundedPool(2, 2)
+	ctx := context.Background()
+	b1, _ := bp.Get(ctx)
+	b2, _ := bp.Get(ctx)
+	ch := make(chan *bytes.Buffer, 1)
+	go func() {
+		b, err := bp.Get(ctx)
+		if err != nil {
+			t.Error("Get returned an error:", err)
+		}
+		ch <- b
+	}()
+	time.Sleep(time.Millisecond * 10)
+	select {
+	case <-ch:
+		t.Error("Get should block when the pool is at capacity")
+	default:
+	}
+	bp.Put(b1)
+	if b := <-ch; b != b1 {
+		t.Error("Blocked Get should receive the returned item")
+	}
+	bp.Discard(b2)
+	stats := bp.Stats()
+	if stats.InUse != 1 || stats.Idle != 0 || stats.Waits != 1 {
+		t.Error("Incorrect pool stats:", stats)
+	}
+	if stats.Created != 2 || stats.Destroyed != 1 || stats.WaitDuration <= 0 {
+		t.Error("Incorrect pool stats:", stats)
+	}
+}
+
+func TestBoundedPoolGetCancel(t *testing.T) {
+	bp := newTestBoundedPool(1, 1)
+	bp.Get(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := bp.Get(ctx); err != context.DeadlineExceeded {
+		t.Error("Get should return the context error:", err)
+	}
+	bp.Close()
+	if _, err := bp.Get(context.Background()); err != ErrPoolClosed {
+		t.Error("Get should return ErrPoolClosed on a closed pool:", err)
+	}
+}
+
+func TestBoundedPoolCloseWakesWaiters(t *testing.T) {
+	bp := newTestBoundedPool(1, 1)
+	if _, err := bp.Get(context.Background()); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	ch := make(chan error, 1)
+	go func() {
+		_, err := bp.Get(context.Background())
+		ch <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	bp.Close()
+	select {
+	case err := <-ch:
+		if err != ErrPoolClosed {
+			t.Error("Expected ErrPoolClosed, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Close should wake waiting Get calls")
+	}
+}
@@ -0,0 +1,313 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned when a Breaker rejects a request because it is
+// open, or because the half-open probe limit has been reached.
+var ErrBreakerOpen = errors.New("ratelim: circuit breaker is open")
+
+// BreakerState is the state of a Breaker.
+type BreakerState int
+
+const (
+	// StateClosed allows all requests through while counting failures.
+	StateClosed BreakerState = iota
+	// StateOpen rejects all requests until the open timeout has passed.
+	StateOpen
+	// StateHalfOpen allows a limited number of probe requests through to
+	// determine whether the breaker should close again.
+	StateHalfOpen
+)
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerCounts holds the request counts of a Breaker for the current
+// generation. Counts are reset whenever the state changes, and every interval
+// while closed.
+type BreakerCounts struct {
+	Requests             int64
+	Successes            int64
+	Failures             int64
+	ConsecutiveSuccesses int64
+	ConsecutiveFailures  int64
+}
+
+// TripFunc decides, after each failure in the closed state, whether a Breaker
+// should trip (change to the open state).
+type TripFunc func(c BreakerCounts) bool
+
+// ConsecutiveFailures returns a TripFunc that trips after "n" consecutive
+// failures.
+func ConsecutiveFailures(n int64) TripFunc {
+	return func(c BreakerCounts) bool {
+		return c.ConsecutiveFailures >= n
+	}
+}
+
+// FailureRatio returns a TripFunc that trips when the ratio of failures to
+// requests reaches "ratio", once at least "min" requests have been made.
+func FailureRatio(ratio float64, min int64) TripFunc {
+	return func(c BreakerCounts) bool {
+		return c.Requests >= min && float64(c.Failures)/float64(c.Requests) >= ratio
+	}
+}
+
+// Breaker is an implementation of the circuit breaker pattern.
+//
+// While closed, requests are allowed and their outcomes are counted. When the
+// TripFunc reports too many failures the breaker opens, and all requests are
+// rejected with ErrBreakerOpen for the open timeout. The breaker then becomes
+// half-open and allows up to "probes" concurrent requests through: if that
+// many succeed in a row it closes, and any failure opens it again.
+//
+// To learn more about the circuit breaker pattern, visit:
+// https://en.wikipedia.org/wiki/Circuit_breaker_design_pattern
+type Breaker struct {
+	// trip decides whether the breaker should open
+	trip TripFunc
+	// interval is the period at which counts are reset while closed
+	interval time.Duration
+	// timeout is the duration the breaker stays open
+	timeout time.Duration
+	// probes is the maximum number of concurrent requests while half-open
+	probes int64
+	// mu is the mutex for accessing any breaker data
+	mu sync.Mutex
+	// state is the current state
+	state BreakerState
+	// gen is incremented on each state change and count reset, so that
+	// outcomes from a previous generation are ignored
+	gen uint64
+	// counts are the counts for the current generation
+	counts BreakerCounts
+	// expiry is the time the current generation ends (zero for never)
+	expiry time.Time
+	// inflight is the number of probe requests in flight while half-open
+	inflight int64
+	// onChange is called after each state change
+	onChange func(from, to BreakerState)
+}
+
+// NewBreaker returns an initialized Breaker pointer in the closed state.
+//
+// The parameter "trip" decides when the breaker opens. The parameter
+// "interval" is the period at which counts are reset while closed (0 never
+// resets them), "timeout" is the duration the breaker stays open before
+// becoming half-open, and "probes" is the number of requests allowed while
+// half-open. If "trip" is nil, ConsecutiveFailures(5) will be used. If "probes"
+// is smaller than 1, the value 1 will be used.
+func NewBreaker(trip TripFunc, interval, timeout time.Duration, probes int64) *Breaker {
+	if trip == nil {
+		trip = ConsecutiveFailures(5)
+	}
+	if probes < 1 {
+		probes = 1
+	}
+	b := &Breaker{
+		trip:     trip,
+		interval: interval,
+		timeout:  timeout,
+		probes:   probes,
+	}
+	b.newGeneration(time.Now())
+	return b
+}
+
+// OnStateChange registers a function that is called after every state change.
+// The function is called synchronously, without any Breaker locks held.
+func (b *Breaker) OnStateChange(f func(from, to BreakerState)) {
+	b.mu.Lock()
+	b.onChange = f
+	b.mu.Unlock()
+}
+
+// State returns the current state of the Breaker.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	state, change := b.current(time.Now())
+	b.mu.Unlock()
+	b.notify(change)
+	return state
+}
+
+// Counts returns the request counts for the current generation.
+func (b *Breaker) Counts() BreakerCounts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.counts
+}
+
+// Allow checks whether a request may proceed.
+//
+// If it may, a function is returned that must be called exactly once with the
+// outcome of the request. Otherwise, ErrBreakerOpen is returned.
+func (b *Breaker) Allow() (func(success bool), error) {
+	b.mu.Lock()
+	state, change := b.current(time.Now())
+	if state == StateOpen || (state == StateHalfOpen && b.inflight >= b.probes) {
+		b.mu.Unlock()
+		b.notify(change)
+		return nil, ErrBreakerOpen
+	}
+	if state == StateHalfOpen {
+		b.inflight += 1
+	}
+	b.counts.Requests += 1
+	gen := b.gen
+	b.mu.Unlock()
+	b.notify(change)
+
+	var once sync.Once
+	return func(success bool) {
+		once.Do(func() { b.done(gen, success) })
+	}, nil
+}
+
+// Execute runs "f" if the Breaker allows it, recording its outcome: a nil
+// error counts as a success and a non-nil error as a failure. If the Breaker
+// rejects the request, ErrBreakerOpen is returned and "f" is not called. If
+// "f" panics, a failure is recorded before the panic continues.
+func (b *Breaker) Execute(f func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			done(false)
+			panic(r)
+		}
+	}()
+	err = f()
+	done(err == nil)
+	return err
+}
+
+// done records the outcome of a request from generation "gen".
+func (b *Breaker) done(gen uint64, success bool) {
+	b.mu.Lock()
+	now := time.Now()
+	state, change := b.current(now)
+	if gen != b.gen {
+		// the outcome belongs to a previous generation, ignore it
+		b.mu.Unlock()
+		b.notify(change)
+		return
+	}
+	if state == StateHalfOpen {
+		b.inflight -= 1
+	}
+	if success {
+		b.counts.Successes += 1
+		b.counts.ConsecutiveSuccesses += 1
+		b.counts.ConsecutiveFailures = 0
+		if state == StateHalfOpen && b.counts.ConsecutiveSuccesses >= b.probes {
+			change = b.setState(StateClosed, now)
+		}
+	} else {
+		b.counts.Failures += 1
+		b.counts.ConsecutiveFailures += 1
+		b.counts.ConsecutiveSuccesses = 0
+		if state == StateHalfOpen || (state == StateClosed && b.trip(b.counts)) {
+			change = b.setState(StateOpen, now)
+		}
+	}
+	b.mu.Unlock()
+	b.notify(change)
+}
+
+// stateChange describes a transition that must be reported to onChange once
+// the lock has been released.
+type stateChange struct {
+	from, to BreakerState
+	f        func(from, to BreakerState)
+}
+
+// notify calls the state change callback, if any.
+func (b *Breaker) notify(c *stateChange) {
+	if c != nil && c.f != nil {
+		c.f(c.from, c.to)
+	}
+}
+
+// current returns the state at time "now", moving from open to half-open or
+// resetting the closed counts if the current generation has expired. The
+// caller must hold b.mu.
+func (b *Breaker) current(now time.Time) (BreakerState, *stateChange) {
+	if b.expiry.IsZero() || now.Before(b.expiry) {
+		return b.state, nil
+	}
+	switch b.state {
+	case StateClosed:
+		b.newGeneration(now)
+	case StateOpen:
+		return StateHalfOpen, b.setState(StateHalfOpen, now)
+	}
+	return b.state, nil
+}
+
+// setState changes the state and starts a new generation. The caller must hold
+// b.mu.
+func (b *Breaker) setState(state BreakerState, now time.Time) *stateChange {
+	if b.state == state {
+		return nil
+	}
+	c := &stateChange{from: b.state, to: state, f: b.onChange}
+	b.state = state
+	b.newGeneration(now)
+	return c
+}
+
+// newGeneration resets the counts and computes the expiry of the new
+// generation. The caller must hold b.mu.
+func (b *Breaker) newGeneration(now time.Time) {
+	b.gen += 1
+	b.counts = BreakerCounts{}
+	b.inflight = 0
+	b.expiry = time.Time{}
+	switch b.state {
+	case StateClosed:
+		if b.interval > 0 {
+			b.expiry = now.Add(b.interval)
+		}
+	case StateOpen:
+		b.expiry = now.Add(b.timeout)
+	}
+}
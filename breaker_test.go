@@ -0,0 +1,127 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errSample = errors.New("sample error")
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	b := NewBreaker(ConsecutiveFailures(3), 0, time.Millisecond*20, 2)
+	var changes []BreakerState
+	b.OnStateChange(func(from, to BreakerState) {
+		changes = append(changes, to)
+	})
+	fail := func() error { return errSample }
+	for i := 0; i < 3; i++ {
+		if err := b.Execute(fail); err != errSample {
+			t.Error("Execute should return the error from f")
+		}
+	}
+	if b.State() != StateOpen {
+		t.Error("Breaker should be open after consecutive failures")
+	}
+	if err := b.Execute(func() error { return nil }); err != ErrBreakerOpen {
+		t.Error("Execute should return ErrBreakerOpen while open")
+	}
+	time.Sleep(time.Millisecond * 30)
+	if b.State() != StateHalfOpen {
+		t.Error("Breaker should be half-open after the timeout")
+	}
+	done1, err1 := b.Allow()
+	done2, err2 := b.Allow()
+	if err1 != nil || err2 != nil {
+		t.Error("Allow should permit probes while half-open")
+	}
+	if _, err := b.Allow(); err != ErrBreakerOpen {
+		t.Error("Allow should enforce the probe limit while half-open")
+	}
+	done1(true)
+	done2(true)
+	if b.State() != StateClosed {
+		t.Error("Breaker should close after successful probes")
+	}
+	want := []BreakerState{StateOpen, StateHalfOpen, StateClosed}
+	if len(changes) != len(want) {
+		t.Fatal("Incorrect state changes:", changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Error("Incorrect state changes:", changes)
+		}
+	}
+}
+
+func TestBreakerExecutePanic(t *testing.T) {
+	b := NewBreaker(ConsecutiveFailures(1), 0, time.Millisecond*20, 1)
+	b.Execute(func() error { return errSample })
+	time.Sleep(time.Millisecond * 30)
+	func() {
+		defer func() {
+			if r := recover(); r != "sample panic" {
+				t.Error("Execute should re-panic, got:", r)
+			}
+		}()
+		b.Execute(func() error { panic("sample panic") })
+	}()
+	if b.State() != StateOpen {
+		t.Error("A panicking probe should reopen the Breaker:", b.State())
+	}
+	time.Sleep(time.Millisecond * 30)
+	if err := b.Execute(func() error { return nil }); err != nil {
+		t.Error("Breaker should allow a new probe after the timeout:", err)
+	}
+}
+
+func TestBreakerFailureRatio(t *testing.T) {
+	b := NewBreaker(FailureRatio(0.5, 4), 0, time.Millisecond*20, 1)
+	b.Execute(func() error { return nil })
+	b.Execute(func() error { return errSample })
+	b.Execute(func() error { return nil })
+	if b.State() != StateClosed {
+		t.Error("Breaker should not trip below the minimum requests")
+	}
+	b.Execute(func() error { return errSample })
+	if b.State() != StateOpen {
+		t.Error("Breaker should trip at the failure ratio")
+	}
+	time.Sleep(time.Millisecond * 30)
+	b.Execute(func() error { return errSample })
+	if b.State() != StateOpen {
+		t.Error("Breaker should reopen after a failed probe")
+	}
+}
+
+func TestBreakerDefaultTrip(t *testing.T) {
+	b := NewBreaker(nil, 0, time.Hour, 0)
+	for i := 0; i < 5; i++ {
+		b.Execute(func() error { return errSample })
+	}
+	if b.State() != StateOpen {
+		t.Error("Breaker should trip after 5 consecutive failures by default")
+	}
+}
@@ -0,0 +1,92 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrLimited is returned when a request is denied by a limiter.
+var ErrLimited = errors.New("ratelim: rate limit exceeded")
+
+// sizedLimiter is implemented by the limiters that can report the largest cost
+// they can ever allow at once.
+type sizedLimiter interface {
+	Capacity() int64
+}
+
+// capacity returns the capacity of "lim", or math.MaxInt64 if it is unknown.
+func capacity(lim interface{}) int64 {
+	if sl, ok := lim.(sizedLimiter); ok {
+		return sl.Capacity()
+	}
+	return math.MaxInt64
+}
+
+// CostLimiter applies a KeyLimiter to requests of type R, charging each request
+// a cost rather than counting it once (e.g. a bulk API call may cost 50 units
+// while a lookup costs 1).
+type CostLimiter[K comparable, R any] struct {
+	// lim is the wrapped limiter
+	lim KeyLimiter[K]
+	// key returns the limiter key for a request
+	key func(R) K
+	// cost returns the cost of a request
+	cost func(R) int64
+}
+
+// NewCostLimiter returns an initialized CostLimiter pointer that charges each
+// request the value returned by "cost" against the key returned by "key" in
+// "lim". If "cost" is nil, every request costs 1.
+func NewCostLimiter[K comparable, R any](lim KeyLimiter[K], key func(R) K, cost func(R) int64) *CostLimiter[K, R] {
+	if cost == nil {
+		cost = func(R) int64 { return 1 }
+	}
+	return &CostLimiter[K, R]{lim: lim, key: key, cost: cost}
+}
+
+// Cost returns the cost of "req".
+func (cl *CostLimiter[K, R]) Cost(req R) int64 {
+	return cl.cost(req)
+}
+
+// Allow charges the cost of "req" to the limiter.
+//
+// It returns nil if the request is allowed. Requests costing nothing are always
+// allowed. If the cost is larger than the capacity of the limiter, ErrTooLarge
+// is returned without charging it, since the request could never be allowed.
+// Otherwise, ErrLimited is returned if the limiter denies the request.
+func (cl *CostLimiter[K, R]) Allow(req R) error {
+	n := cl.cost(req)
+	if n < 1 {
+		return nil
+	}
+	if n > capacity(cl.lim) {
+		return ErrTooLarge
+	}
+	if !cl.lim.IncBy(cl.key(req), n) {
+		return ErrLimited
+	}
+	return nil
+}
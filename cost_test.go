@@ -0,0 +1,81 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type sampleRequest struct {
+	user string
+	size int64
+}
+
+func TestCostLimiter(t *testing.T) {
+	lim := NewLimiter(10, time.Hour)
+	defer lim.Close()
+	cl := NewCostLimiter(lim, func(r sampleRequest) string { return r.user },
+		func(r sampleRequest) int64 { return r.size })
+	if err := cl.Allow(sampleRequest{"sample1", 11}); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got:", err)
+	}
+	if err := cl.Allow(sampleRequest{"sample1", 8}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := cl.Allow(sampleRequest{"sample1", 3}); err != ErrLimited {
+		t.Error("Expected ErrLimited, got:", err)
+	}
+	if err := cl.Allow(sampleRequest{"sample1", 0}); err != nil {
+		t.Error("Free requests should be allowed:", err)
+	}
+	if err := cl.Allow(sampleRequest{"sample1", 2}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	lim := NewLimiter(10, time.Hour)
+	defer lim.Close()
+	pb := NewPenaltyBox[string](lim, 1)
+	defer pb.Close()
+	il := NewIPLimiter(time.Hour, IPLevel{Max: 10}, IPLevel{V4Bits: 24, Max: 4})
+	defer il.Close()
+	ipb := NewPenaltyBox[netip.Addr](il, 1)
+	defer ipb.Close()
+	tests := []struct {
+		lim  interface{}
+		want int64
+	}{
+		{lim, 10},
+		{pb, 10},
+		{il, 4},
+		{ipb, 4},
+	}
+	for i, test := range tests {
+		if got := capacity(test.lim); got != test.want {
+			t.Error("Incorrect capacity:", i, got)
+		}
+	}
+}
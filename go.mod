@@ -0,0 +1,3 @@
+module github.com/ryanfowler/ratelim
+
+go 1.24
@@ -0,0 +1,205 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// IPKeyer maps IP addresses to the network prefixes used as limiter keys.
+//
+// Keying a limiter by the full address lets a client bypass it by rotating
+// through the addresses it controls, which for IPv6 is usually at least a /64.
+// Masking addresses to a prefix makes all of them share the same key.
+type IPKeyer struct {
+	// v4Bits is the prefix length used for IPv4 addresses
+	v4Bits int
+	// v6Bits is the prefix length used for IPv6 addresses
+	v6Bits int
+}
+
+// NewIPKeyer returns an IPKeyer that masks IPv4 addresses to "v4Bits" and IPv6
+// addresses to "v6Bits". Out of range values are replaced with the defaults of
+// 32 and 64 respectively.
+func NewIPKeyer(v4Bits, v6Bits int) IPKeyer {
+	if v4Bits < 0 || v4Bits > 32 {
+		v4Bits = 32
+	}
+	if v6Bits < 0 || v6Bits > 128 {
+		v6Bits = 64
+	}
+	return IPKeyer{v4Bits: v4Bits, v6Bits: v6Bits}
+}
+
+// Key returns the prefix containing "addr". IPv4-mapped IPv6 addresses are
+// treated as IPv4 addresses. An invalid address returns the zero prefix.
+func (k IPKeyer) Key(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := k.v6Bits
+	if addr.Is4() {
+		bits = k.v4Bits
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	return prefix
+}
+
+// ParseKey parses "s", which is either an IP address or an "ip:port" pair (as
+// in http.Request.RemoteAddr), and returns the prefix containing the address.
+func (k IPKeyer) ParseKey(s string) (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		ap, aerr := netip.ParseAddrPort(s)
+		if aerr != nil {
+			return netip.Prefix{}, err
+		}
+		addr = ap.Addr()
+	}
+	return k.Key(addr), nil
+}
+
+// IPLevel is a single level of an IPLimiter.
+type IPLevel struct {
+	// V4Bits is the prefix length for IPv4 addresses at this level, or 32 if
+	// zero
+	V4Bits int
+	// V6Bits is the prefix length for IPv6 addresses at this level, or 64 if
+	// zero
+	V6Bits int
+	// Max is the maximum number of events per prefix within each window
+	Max int64
+}
+
+// ipLevel is the limiter for a single level of an IPLimiter.
+type ipLevel struct {
+	// keyer maps addresses to the level's prefixes
+	keyer IPKeyer
+	// lim counts the events per prefix
+	lim *LimiterOf[netip.Prefix]
+}
+
+// IPLimiter limits the number of events per IP address, with hierarchical
+// limits on the networks containing it.
+//
+// Each level has its own prefix lengths and maximum, e.g. 10 events per /32
+// (or /64 for IPv6) and 100 events per /24 (or /48). An event is allowed only
+// if every level allows it, and is not counted by any level otherwise.
+// Addresses within an allowed prefix are never limited.
+type IPLimiter struct {
+	// levels holds the limiter for each level
+	levels []ipLevel
+	// mu is the mutex for accessing allow
+	mu sync.RWMutex
+	// allow holds the prefixes that are never limited
+	allow prefixSet
+}
+
+// NewIPLimiter returns an initialized IPLimiter pointer that applies each of
+// the provided levels within windows of length "dur". With no levels, every
+// event is allowed.
+//
+// Close must be called to stop the internal timers once the limiter will no
+// longer be used.
+func NewIPLimiter(dur time.Duration, levels ...IPLevel) *IPLimiter {
+	il := &IPLimiter{levels: make([]ipLevel, len(levels))}
+	for i, l := range levels {
+		if l.V4Bits == 0 {
+			l.V4Bits = 32
+		}
+		if l.V6Bits == 0 {
+			l.V6Bits = 64
+		}
+		il.levels[i] = ipLevel{
+			keyer: NewIPKeyer(l.V4Bits, l.V6Bits),
+			lim:   NewLimiterOf[netip.Prefix](l.Max, dur),
+		}
+	}
+	return il
+}
+
+// Close stops the internal timers of every level.
+func (il *IPLimiter) Close() {
+	for _, l := range il.levels {
+		l.lim.Close()
+	}
+}
+
+// Capacity returns the smallest maximum of all levels, which is the largest
+// value that can be added at once, or math.MaxInt64 if there are no levels.
+func (il *IPLimiter) Capacity() int64 {
+	c := int64(math.MaxInt64)
+	for _, l := range il.levels {
+		c = min(c, l.lim.Capacity())
+	}
+	return c
+}
+
+// Inc records a single event for "addr". See IncBy for more information.
+func (il *IPLimiter) Inc(addr netip.Addr) bool {
+	return il.IncBy(addr, 1)
+}
+
+// IncBy records an event of "val" for "addr", returning true if it is allowed
+// by every level. If any level denies the event, the levels that allowed it
+// are rolled back and false is returned.
+func (il *IPLimiter) IncBy(addr netip.Addr, val int64) bool {
+	if il.Allowed(addr) {
+		return true
+	}
+	for i, l := range il.levels {
+		if !l.lim.IncBy(l.keyer.Key(addr), val) {
+			for _, prev := range il.levels[:i] {
+				prev.lim.DecBy(prev.keyer.Key(addr), val)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Allowed returns true if "addr" is within an allowed prefix.
+func (il *IPLimiter) Allowed(addr netip.Addr) bool {
+	il.mu.RLock()
+	defer il.mu.RUnlock()
+	return il.allow.contains(addr)
+}
+
+// AllowPrefix adds "prefix" to the allow list, so that addresses within it are
+// never limited.
+func (il *IPLimiter) AllowPrefix(prefix netip.Prefix) {
+	il.mu.Lock()
+	il.allow.add(prefix)
+	il.mu.Unlock()
+}
+
+// RemovePrefix removes "prefix" from the allow list.
+func (il *IPLimiter) RemovePrefix(prefix netip.Prefix) {
+	il.mu.Lock()
+	il.allow.remove(prefix)
+	il.mu.Unlock()
+}
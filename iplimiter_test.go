@@ -0,0 +1,122 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIPKeyer(t *testing.T) {
+	k := NewIPKeyer(24, 64)
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.55", "192.0.2.0/24"},
+		{"192.0.2.55:8080", "192.0.2.0/24"},
+		{"::ffff:192.0.2.55", "192.0.2.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2::9]:443", "2001:db8:1:2::/64"},
+	}
+	for _, test := range tests {
+		got, err := k.ParseKey(test.in)
+		if err != nil || got.String() != test.want {
+			t.Error("Incorrect key for", test.in, got, err)
+		}
+	}
+	if _, err := k.ParseKey("not an ip"); err == nil {
+		t.Error("Expected error for invalid address")
+	}
+}
+
+func TestIPLimiterHierarchy(t *testing.T) {
+	il := NewIPLimiter(time.Hour,
+		IPLevel{V4Bits: 32, V6Bits: 64, Max: 2},
+		IPLevel{V4Bits: 24, V6Bits: 48, Max: 3},
+	)
+	defer il.Close()
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+	if !il.Inc(a) || !il.Inc(a) {
+		t.Error("Events within the limits should be allowed")
+	}
+	if il.Inc(a) {
+		t.Error("Address should be limited")
+	}
+	if !il.Inc(b) {
+		t.Error("Other address in the subnet should be allowed")
+	}
+	if il.Inc(b) {
+		t.Error("Subnet should be limited")
+	}
+	// rotating through a /64 should not bypass the limit
+	v6 := []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}
+	var oks int
+	for _, s := range v6 {
+		if il.Inc(netip.MustParseAddr(s)) {
+			oks += 1
+		}
+	}
+	if oks != 2 {
+		t.Error("Incorrect number of IPv6 events allowed:", oks)
+	}
+}
+
+func TestIPLimiterRollback(t *testing.T) {
+	il := NewIPLimiter(time.Hour,
+		IPLevel{V4Bits: 32, Max: 5},
+		IPLevel{V4Bits: 24, Max: 1},
+	)
+	defer il.Close()
+	a := netip.MustParseAddr("192.0.2.1")
+	il.Inc(a)
+	for i := 0; i < 3; i++ {
+		il.Inc(a)
+	}
+	il.levels[1].lim.ClearAll()
+	// the denied events must not have been counted by the first level
+	for i := 0; i < 4; i++ {
+		if !il.levels[0].lim.Inc(il.levels[0].keyer.Key(a)) {
+			t.Error("Denied events should be rolled back")
+		}
+	}
+}
+
+func TestIPLimiterAllowPrefix(t *testing.T) {
+	il := NewIPLimiter(time.Hour, IPLevel{Max: 1})
+	defer il.Close()
+	il.AllowPrefix(netip.MustParsePrefix("10.0.0.0/8"))
+	addr := netip.MustParseAddr("10.1.1.1")
+	for i := 0; i < 3; i++ {
+		if !il.Inc(addr) {
+			t.Error("Allowed prefix should never be limited")
+		}
+	}
+	il.RemovePrefix(netip.MustParsePrefix("10.0.0.0/8"))
+	il.Inc(addr)
+	if il.Inc(addr) {
+		t.Error("Removed prefix should be limited")
+	}
+}
@@ -24,35 +24,98 @@ package ratelim
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type Limiter struct {
-	cache  map[string]int64
+// limEntry is the count for a single key in a LimiterOf.
+type limEntry[K comparable] struct {
+	// count is the number of events in the key's current window
+	count int64
+	// expires is the time the key's current window ends
+	expires time.Time
+	// elem is the key's element in the LRU list, if the limiter is bounded
+	elem *ElementOf[K]
+}
+
+// LimiterOf limits the number of events per key of type K within a time
+// window.
+//
+// Each key has its own window, which starts with the key's first event and
+// lasts for the configured duration. Keys whose window has ended are removed
+// lazily on their next event, and periodically by an internal timer.
+type LimiterOf[K comparable] struct {
+	cache  map[K]*limEntry[K]
 	mu     sync.Mutex
 	max    int64
+	dur    time.Duration
 	ticker *time.Ticker
 	cch    chan struct{}
 	closed bool
+	// maxKeys is the maximum number of keys tracked (0 for unbounded)
+	maxKeys int
+	// lru orders the keys from least to most recently used, if bounded
+	lru *ListOf[K]
+	// evictions is the number of keys evicted to respect maxKeys
+	evictions int64
+	// onEvict is called with each evicted key and its count
+	onEvict func(key K, count int64)
+	// tracker tracks the heaviest keys, if enabled
+	tracker atomic.Pointer[keyTracker[K]]
 }
 
+// Limiter is a LimiterOf with string keys. It is kept for compatibility with
+// code written before LimiterOf was introduced.
+type Limiter = LimiterOf[string]
+
 func NewLimiter(max int64, dur time.Duration) *Limiter {
-	lim := &Limiter{
-		cache:  make(map[string]int64),
+	return NewLimiterOf[string](max, dur)
+}
+
+// NewLimiterOf returns an initialized LimiterOf pointer that allows at most
+// "max" events per key within each window of length "dur".
+func NewLimiterOf[K comparable](max int64, dur time.Duration) *LimiterOf[K] {
+	return NewBoundedLimiterOf[K](max, dur, 0)
+}
+
+// NewBoundedLimiter returns an initialized Limiter pointer that tracks at most
+// "maxKeys" keys. See NewBoundedLimiterOf for more information.
+func NewBoundedLimiter(max int64, dur time.Duration, maxKeys int) *Limiter {
+	return NewBoundedLimiterOf[string](max, dur, maxKeys)
+}
+
+// NewBoundedLimiterOf returns an initialized LimiterOf pointer that allows at
+// most "max" events per key within each window of length "dur", and tracks at
+// most "maxKeys" keys at once.
+//
+// When a new key would exceed "maxKeys", the least recently used key is
+// evicted, which resets its count. This bounds memory usage when keys are
+// attacker controlled (e.g. spoofed IP addresses), at the cost of forgetting
+// the counts of idle keys. If "maxKeys" is smaller than 1, the number of keys
+// is unbounded.
+func NewBoundedLimiterOf[K comparable](max int64, dur time.Duration, maxKeys int) *LimiterOf[K] {
+	lim := &LimiterOf[K]{
+		cache:  make(map[K]*limEntry[K]),
 		mu:     sync.Mutex{},
 		max:    max,
+		dur:    dur,
 		ticker: time.NewTicker(dur),
 		cch:    make(chan struct{}, 1),
 	}
+	if maxKeys > 0 {
+		lim.maxKeys = maxKeys
+		lim.lru = NewListOf[K]()
+	}
 	go lim.tick()
 	return lim
 }
 
-func (lim *Limiter) tick() {
+func (lim *LimiterOf[K]) tick() {
 	for {
 		select {
 		case <-lim.ticker.C:
-			lim.ClearAll()
+			lim.sweep()
+			lim.tracker.Load().reset()
 		case <-lim.cch:
 			lim.ticker.Stop()
 			lim.ClearAll()
@@ -61,7 +124,7 @@ func (lim *Limiter) tick() {
 	}
 }
 
-func (lim *Limiter) Close() {
+func (lim *LimiterOf[K]) Close() {
 	lim.mu.Lock()
 	if lim.closed {
 		lim.mu.Unlock()
@@ -72,45 +135,167 @@ func (lim *Limiter) Close() {
 	lim.cch <- struct{}{}
 }
 
-func (lim *Limiter) IsClosed() bool {
+func (lim *LimiterOf[K]) IsClosed() bool {
 	lim.mu.Lock()
 	defer lim.mu.Unlock()
 	return lim.closed
 }
 
-func (lim *Limiter) Inc(key string) bool {
+// Capacity returns the maximum count per key, which is the largest value that
+// can be added at once.
+func (lim *LimiterOf[K]) Capacity() int64 {
+	return lim.max
+}
+
+func (lim *LimiterOf[K]) Inc(key K) bool {
 	return lim.IncBy(key, 1)
 }
 
-func (lim *Limiter) IncBy(key string, val int64) bool {
+func (lim *LimiterOf[K]) IncBy(key K, val int64) bool {
+	ok := lim.incBy(key, val)
+	lim.tracker.Load().observe(key, val, ok)
+	return ok
+}
+
+func (lim *LimiterOf[K]) incBy(key K, val int64) bool {
 	lim.mu.Lock()
-	if lim.cache[key]+val > lim.max {
-		lim.mu.Unlock()
+	defer lim.mu.Unlock()
+	now := time.Now()
+	e, ok := lim.cache[key]
+	if !ok {
+		// unknown key, don't track it unless the event is allowed
+		if val > lim.max {
+			return false
+		}
+		e = lim.add(key)
+	} else if lim.lru != nil {
+		lim.lru.MoveToBack(e.elem)
+	}
+	if !now.Before(e.expires) {
+		// no current window for the key, start a new one
+		e.count = 0
+		e.expires = now.Add(lim.dur)
+	}
+	if e.count+val > lim.max {
 		return false
 	}
-	lim.cache[key] += val
-	lim.mu.Unlock()
+	e.count += val
 	return true
 }
 
-func (lim *Limiter) Dec(key string) bool {
+func (lim *LimiterOf[K]) Dec(key K) bool {
 	return lim.IncBy(key, -1)
 }
 
-func (lim *Limiter) DecBy(key string, val int64) bool {
+func (lim *LimiterOf[K]) DecBy(key K, val int64) bool {
 	return lim.IncBy(key, -val)
 }
 
-func (lim *Limiter) Clear(key string) {
+func (lim *LimiterOf[K]) Clear(key K) {
 	lim.mu.Lock()
-	delete(lim.cache, key)
+	if e, ok := lim.cache[key]; ok {
+		lim.remove(key, e)
+	}
 	lim.mu.Unlock()
 }
 
-func (lim *Limiter) ClearAll() {
+func (lim *LimiterOf[K]) ClearAll() {
 	lim.mu.Lock()
 	if len(lim.cache) > 0 {
-		lim.cache = make(map[string]int64)
+		lim.cache = make(map[K]*limEntry[K])
+		if lim.lru != nil {
+			lim.lru.Empty()
+		}
+	}
+	lim.mu.Unlock()
+}
+
+// Evictions returns the number of keys that have been evicted to keep the
+// number of keys within the maximum.
+func (lim *LimiterOf[K]) Evictions() int64 {
+	return atomic.LoadInt64(&lim.evictions)
+}
+
+// Len returns the number of keys currently tracked.
+func (lim *LimiterOf[K]) Len() int {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return len(lim.cache)
+}
+
+// TrackTopKeys enables tracking of the heaviest keys, by requested and by denied
+// counts, monitoring at most "capacity" keys each. Counts are reset every
+// window. Calling it again resets the counts.
+func (lim *LimiterOf[K]) TrackTopKeys(capacity int) {
+	lim.tracker.Store(newKeyTracker[K](capacity))
+}
+
+// TopKeys returns the "k" keys with the highest requested counts in the current
+// window, or nil if TrackTopKeys has not been called.
+func (lim *LimiterOf[K]) TopKeys(k int) []KeyCount[K] {
+	if kt := lim.tracker.Load(); kt != nil {
+		return kt.volume.Top(k)
+	}
+	return nil
+}
+
+// TopDenied returns the "k" keys with the highest denied counts in the current
+// window, or nil if TrackTopKeys has not been called.
+func (lim *LimiterOf[K]) TopDenied(k int) []KeyCount[K] {
+	if kt := lim.tracker.Load(); kt != nil {
+		return kt.denials.Top(k)
+	}
+	return nil
+}
+
+// OnEvict registers a function that is called with each key evicted to keep
+// the number of keys within the maximum, and the key's count at the time. The
+// function is called with the limiter locked, so it must not call any of the
+// limiter's functions.
+func (lim *LimiterOf[K]) OnEvict(f func(key K, count int64)) {
+	lim.mu.Lock()
+	lim.onEvict = f
+	lim.mu.Unlock()
+}
+
+// add starts tracking "key", evicting the least recently used key first if
+// the limiter is full. The caller must hold lim.mu.
+func (lim *LimiterOf[K]) add(key K) *limEntry[K] {
+	if lim.lru != nil && len(lim.cache) >= lim.maxKeys {
+		if front := lim.lru.Front(); front != nil {
+			old := front.Value
+			count := lim.cache[old].count
+			lim.remove(old, lim.cache[old])
+			atomic.AddInt64(&lim.evictions, 1)
+			if lim.onEvict != nil {
+				lim.onEvict(old, count)
+			}
+		}
+	}
+	e := &limEntry[K]{}
+	if lim.lru != nil {
+		e.elem = lim.lru.PushBack(key)
+	}
+	lim.cache[key] = e
+	return e
+}
+
+// remove stops tracking "key". The caller must hold lim.mu.
+func (lim *LimiterOf[K]) remove(key K, e *limEntry[K]) {
+	delete(lim.cache, key)
+	if lim.lru != nil {
+		lim.lru.Remove(e.elem)
+	}
+}
+
+// sweep removes the keys whose window has ended.
+func (lim *LimiterOf[K]) sweep() {
+	lim.mu.Lock()
+	now := time.Now()
+	for key, e := range lim.cache {
+		if !now.Before(e.expires) {
+			lim.remove(key, e)
+		}
 	}
 	lim.mu.Unlock()
 }
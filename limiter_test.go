@@ -75,3 +75,63 @@ func TestLimiterClose(t *testing.T) {
 	}
 	lim.Close()
 }
+
+func TestLimiterOf(t *testing.T) {
+	lim := NewLimiterOf[int](2, time.Second)
+	defer lim.Close()
+	if !lim.Inc(1) || !lim.Inc(1) || lim.Inc(1) {
+		t.Error("Incorrect increment successes")
+	}
+	if !lim.Inc(2) {
+		t.Error("Keys should not share counts")
+	}
+}
+
+func TestLimiterWindows(t *testing.T) {
+	lim := NewLimiter(1, time.Millisecond*50)
+	defer lim.Close()
+	lim.Inc("sample1")
+	time.Sleep(time.Millisecond * 30)
+	lim.Inc("sample2")
+	time.Sleep(time.Millisecond * 30)
+	if !lim.Inc("sample1") {
+		t.Error("Window for sample1 should have ended")
+	}
+	if lim.Inc("sample2") {
+		t.Error("Window for sample2 should not have ended")
+	}
+	time.Sleep(time.Millisecond * 120)
+	lim.mu.Lock()
+	n := len(lim.cache)
+	lim.mu.Unlock()
+	if n != 0 {
+		t.Error("Expired keys should be swept:", n)
+	}
+}
+
+func TestBoundedLimiter(t *testing.T) {
+	lim := NewBoundedLimiter(10, time.Second, 2)
+	defer lim.Close()
+	var evicted []string
+	lim.OnEvict(func(key string, count int64) {
+		evicted = append(evicted, key)
+	})
+	lim.IncBy("sample1", 10)
+	lim.Inc("sample2")
+	// sample1 becomes the most recently used key
+	lim.Inc("sample1")
+	lim.Inc("sample3")
+	if lim.Len() != 2 || lim.Evictions() != 1 {
+		t.Error("Incorrect key count or evictions:", lim.Len(), lim.Evictions())
+	}
+	if len(evicted) != 1 || evicted[0] != "sample2" {
+		t.Error("Least recently used key should be evicted:", evicted)
+	}
+	if lim.Inc("sample1") {
+		t.Error("Count for sample1 should not have been reset")
+	}
+	lim.Clear("sample1")
+	if lim.Len() != 1 || lim.lru.Len() != 1 {
+		t.Error("Clear should remove the key from the LRU list")
+	}
+}
@@ -23,51 +23,274 @@
 package ratelim
 
 import (
+	"context"
+	"errors"
+	"iter"
 	"sync"
+	"sync/atomic"
 )
 
-// lnode represents a single node in a List
-type lnode struct {
-	// next is the next item in the List
-	next *lnode
-	// prev is the previous item in the List
-	prev *lnode
-	// value is the actual value for the node
-	value interface{}
+// ErrListClosed is returned when blocking on a List that has been closed.
+var ErrListClosed = errors.New("ratelim: list is closed")
+
+// ElementOf represents a single node in a ListOf. It is returned when a value
+// is pushed to or inserted into a ListOf, and can be used as a handle to
+// remove or move the value later.
+type ElementOf[T any] struct {
+	// next is the next item in the ListOf
+	next *ElementOf[T]
+	// prev is the previous item in the ListOf
+	prev *ElementOf[T]
+	// list is the ListOf the element belongs to, or nil once removed. It is
+	// only modified with the list locked, but is read atomically by Next and
+	// Prev to find which list to lock.
+	list atomic.Pointer[ListOf[T]]
+	// Value is the actual value for the node
+	Value T
 }
 
-// List represents a light-weight implementation of a doubly linked list.
+// Element is an ElementOf in a List.
+type Element = ElementOf[interface{}]
+
+// Next returns the next element in the list (towards the tail), or nil if
+// there is none or the element has been removed.
+func (e *ElementOf[T]) Next() *ElementOf[T] {
+	l := e.list.Load()
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.list.Load() != l {
+		return nil
+	}
+	return e.next
+}
+
+// Prev returns the previous element in the list (towards the head), or nil if
+// there is none or the element has been removed.
+func (e *ElementOf[T]) Prev() *ElementOf[T] {
+	l := e.list.Load()
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.list.Load() != l {
+		return nil
+	}
+	return e.prev
+}
+
+// ListOf represents a light-weight implementation of a doubly linked list
+// holding values of type T.
 //
 // To learn more about doubly linked lists, visit:
 // https://en.wikipedia.org/wiki/Doubly_linked_list
-type List struct {
+type ListOf[T any] struct {
 	// head is a pointer to the head node
-	head *lnode
+	head *ElementOf[T]
 	// tail is a pointer to the tail node
-	tail *lnode
+	tail *ElementOf[T]
 	// mu is the mutex for accessing any list data
 	mu sync.Mutex
 	// length is the total length of the list
 	length int
+	// max is the maximum length of the list (0 for unbounded)
+	max int
+	// signal is closed and reset whenever the list changes, waking any
+	// goroutines blocked on it
+	signal chan struct{}
+	// closed indicates whether the list is closed
+	closed bool
 }
 
+// List is a ListOf holding values of any type. It is kept for compatibility
+// with code written before ListOf was introduced.
+type List = ListOf[interface{}]
+
 // NewList returns an initialized List pointer.
 func NewList() *List {
-	return &List{
+	return NewListOf[interface{}]()
+}
+
+// NewListOf returns an initialized ListOf pointer.
+func NewListOf[T any]() *ListOf[T] {
+	return &ListOf[T]{
 		mu: sync.Mutex{},
 	}
 }
 
+// NewBoundedList returns an initialized List pointer that holds at most "max"
+// items. See NewBoundedListOf for more information.
+func NewBoundedList(max int) *List {
+	return NewBoundedListOf[interface{}](max)
+}
+
+// NewBoundedListOf returns an initialized ListOf pointer that holds at most
+// "max" items. When the list is full, LPush, RPush, InsertAfter and
+// InsertBefore fail and return nil, while BLPush and BRPush block until there
+// is room. If "max" is smaller than 1, the list is unbounded.
+func NewBoundedListOf[T any](max int) *ListOf[T] {
+	if max < 0 {
+		max = 0
+	}
+	return &ListOf[T]{
+		mu:  sync.Mutex{},
+		max: max,
+	}
+}
+
+// Backward returns an iterator over the index and value of each item in the
+// List, starting from the right-most node (the tail). Indexes count down from
+// the length of the List when iteration started. See All for more information.
+func (l *ListOf[T]) Backward() iter.Seq2[int, T] {
+	return func(yield func(int, T) bool) {
+		l.walk(false, func(i int, _ *ElementOf[T], v T) bool {
+			return yield(i, v)
+		})
+	}
+}
+
+// BLPop removes the left-most node from the List (i.e. the head), and returns
+// it's value, blocking until an item is available or the context is done.
+//
+// It returns ctx.Err() if the context is done first, or ErrListClosed if the
+// List is closed and empty.
+func (l *ListOf[T]) BLPop(ctx context.Context) (T, error) {
+	return l.bpop(ctx, true)
+}
+
+// BLPush inserts the provided value to the left-most position in the list (the
+// head position), blocking until there is room in a bounded List or the context
+// is done.
+//
+// It returns the new element, or ctx.Err() if the context is done first, or
+// ErrListClosed if the List is closed.
+func (l *ListOf[T]) BLPush(ctx context.Context, v T) (*ElementOf[T], error) {
+	return l.bpush(ctx, v, true)
+}
+
+// BRPop removes the right-most node from the List (i.e. the tail), and returns
+// it's value, blocking until an item is available or the context is done.
+//
+// It returns ctx.Err() if the context is done first, or ErrListClosed if the
+// List is closed and empty.
+func (l *ListOf[T]) BRPop(ctx context.Context) (T, error) {
+	return l.bpop(ctx, false)
+}
+
+// BRPush inserts the provided value to the right-most position in the list
+// (the tail position), blocking until there is room in a bounded List or the
+// context is done.
+//
+// It returns the new element, or ctx.Err() if the context is done first, or
+// ErrListClosed if the List is closed.
+func (l *ListOf[T]) BRPush(ctx context.Context, v T) (*ElementOf[T], error) {
+	return l.bpush(ctx, v, false)
+}
+
+// All returns an iterator over the index and value of each item in the List,
+// starting from the left-most node (the head).
+//
+// The List is only locked while moving from one node to the next, not while
+// the loop body runs. The loop body may therefore modify the List, including
+// removing the current or any later element, which is then skipped; items
+// pushed or inserted during iteration are not visited. Indexes count the items
+// visited so far.
+func (l *ListOf[T]) All() iter.Seq2[int, T] {
+	return func(yield func(int, T) bool) {
+		l.walk(true, func(i int, _ *ElementOf[T], v T) bool {
+			return yield(i, v)
+		})
+	}
+}
+
+// Back returns the right-most element of the List (the tail), or nil if the
+// List is empty.
+func (l *ListOf[T]) Back() *ElementOf[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tail
+}
+
+// Close closes the List, waking all goroutines blocked in BLPop, BRPop, BLPush
+// or BRPush. Items remaining in the List can still be popped, but no new items
+// can be pushed or inserted.
+//
+// It returns true if the List has been closed, or false if the List has
+// already been closed.
+func (l *ListOf[T]) Close() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.closed = true
+	l.notify()
+	return true
+}
+
 // Empty removes all items from the List. After calling this function, the
 // length of the list is 0.
-func (l *List) Empty() {
+func (l *ListOf[T]) Empty() {
 	l.mu.Lock()
+	// detach the elements, so stale handles can't modify the list
+	for n := l.head; n != nil; n = n.next {
+		n.list.Store(nil)
+	}
 	l.head = nil
 	l.tail = nil
 	l.length = 0
+	l.notify()
 	l.mu.Unlock()
 }
 
+// Elements returns an iterator over each element in the List, starting from
+// the left-most node (the head). The elements can be used to remove or move
+// items while iterating. See All for more information.
+func (l *ListOf[T]) Elements() iter.Seq[*ElementOf[T]] {
+	return func(yield func(*ElementOf[T]) bool) {
+		l.walk(true, func(_ int, e *ElementOf[T], _ T) bool {
+			return yield(e)
+		})
+	}
+}
+
+// Front returns the left-most element of the List (the head), or nil if the
+// List is empty.
+func (l *ListOf[T]) Front() *ElementOf[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head
+}
+
+// InsertAfter inserts the provided value immediately after the element
+// "mark", and returns the new element. If "mark" is not an element of the
+// List, or the List is full or closed, the List is not modified and nil is
+// returned.
+func (l *ListOf[T]) InsertAfter(v T, mark *ElementOf[T]) *ElementOf[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if mark == nil || mark.list.Load() != l || l.full() {
+		return nil
+	}
+	return l.insert(&ElementOf[T]{Value: v}, mark)
+}
+
+// InsertBefore inserts the provided value immediately before the element
+// "mark", and returns the new element. If "mark" is not an element of the
+// List, or the List is full or closed, the List is not modified and nil is
+// returned.
+func (l *ListOf[T]) InsertBefore(v T, mark *ElementOf[T]) *ElementOf[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if mark == nil || mark.list.Load() != l || l.full() {
+		return nil
+	}
+	return l.insert(&ElementOf[T]{Value: v}, mark.prev)
+}
+
 // LEach iterates over each item in the List, starting from the left-most node
 // (the head).
 //
@@ -75,66 +298,117 @@ func (l *List) Empty() {
 // (zero-based), and the value of the current node. This function should return
 // true to continue the iteration, or false to immediately stop and return from
 // the LEach function.
-func (l *List) LEach(f func(int, interface{}) bool) {
-	l.mu.Lock()
-	n := l.head
-	var c int
-	for n != nil {
-		if !f(c, n.value) {
-			l.mu.Unlock()
-			return
-		}
-		c += 1
-		n = n.next
-	}
-	l.mu.Unlock()
+//
+// The List is not locked while "f" runs, so "f" may modify the List. See All
+// for more information.
+func (l *ListOf[T]) LEach(f func(int, T) bool) {
+	l.walk(true, func(i int, _ *ElementOf[T], v T) bool {
+		return f(i, v)
+	})
 }
 
 // LPop removes the left-most node from the List (i.e. the head), and returns
-// it's value.
-func (l *List) LPop() interface{} {
+// it's value. If the List is empty, the zero value of T (nil for List) is
+// returned.
+func (l *ListOf[T]) LPop() T {
 	// lock the list, unlock on return
 	l.mu.Lock()
 	// retrieve head
 	if h := l.head; h != nil {
+		h.list.Store(nil)
 		if l.length == 1 {
 			l.length = 0
 			l.head = nil
 			l.tail = nil
+			l.notify()
 			l.mu.Unlock()
-			return h.value
+			return h.Value
 		}
 		l.length -= 1
 		l.head = h.next
 		l.head.prev = nil
+		l.notify()
 		l.mu.Unlock()
-		return h.value
+		return h.Value
 	}
 	l.mu.Unlock()
-	return nil
+	var zero T
+	return zero
 }
 
 // LPush inserts the provided value to the left-most position in the list (the
-// head position).
-func (l *List) LPush(v interface{}) {
-	// create new node
-	n := &lnode{
-		value: v,
+// head position). If the List is full or closed, the value is not inserted;
+// use PushFront to find out.
+func (l *ListOf[T]) LPush(v T) {
+	l.PushFront(v)
+}
+
+// PushBack inserts the provided value to the right-most position in the list
+// (the tail position), and returns the new element. If the List is full or
+// closed, the value is not inserted and nil is returned.
+func (l *ListOf[T]) PushBack(v T) *ElementOf[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.full() {
+		return nil
 	}
-	// lock the list, unlock on return
+	return l.insert(&ElementOf[T]{Value: v}, l.tail)
+}
+
+// PushFront inserts the provided value to the left-most position in the list
+// (the head position), and returns the new element. If the List is full or
+// closed, the value is not inserted and nil is returned.
+func (l *ListOf[T]) PushFront(v T) *ElementOf[T] {
 	l.mu.Lock()
-	// add node to head
-	l.length += 1
-	if h := l.head; h != nil {
-		h.prev = n
-		n.next = h
-		l.head = n
-		l.mu.Unlock()
+	defer l.mu.Unlock()
+	if l.full() {
+		return nil
+	}
+	return l.insert(&ElementOf[T]{Value: v}, nil)
+}
+
+// IsClosed returns true if the List has been closed. It returns false if it is
+// still open.
+func (l *ListOf[T]) IsClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Len returns the number of items in the List.
+func (l *ListOf[T]) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.length
+}
+
+// MoveToBack moves the element "e" to the right-most position in the List (the
+// tail position). If "e" is nil or not an element of the List, the List is not
+// modified.
+func (l *ListOf[T]) MoveToBack(e *ElementOf[T]) {
+	if e == nil {
+		return
+	}
+	l.mu.Lock()
+	if e.list.Load() == l && l.tail != e {
+		l.unlink(e)
+		l.insert(e, l.tail)
+	}
+	l.mu.Unlock()
+}
+
+// MoveToFront moves the element "e" to the left-most position in the List (the
+// head position). If "e" is nil or not an element of the List, the List is not
+// modified.
+func (l *ListOf[T]) MoveToFront(e *ElementOf[T]) {
+	if e == nil {
 		return
 	}
-	// list is empty, assign node to head & tail
-	l.head = n
-	l.tail = n
+	l.mu.Lock()
+	if e.list.Load() == l && l.head != e {
+		l.unlink(e)
+		l.insert(e, nil)
+	}
 	l.mu.Unlock()
 }
 
@@ -145,84 +419,258 @@ func (l *List) LPush(v interface{}) {
 // (zero-based), and the value of the current node. This function should return
 // true to continue the iteration, or false to immediately stop and return from
 // the REach function.
-func (l *List) REach(f func(int, interface{}) bool) {
+//
+// The List is not locked while "f" runs, so "f" may modify the List. See All
+// for more information.
+func (l *ListOf[T]) REach(f func(int, T) bool) {
+	l.walk(false, func(i int, _ *ElementOf[T], v T) bool {
+		return f(i, v)
+	})
+}
+
+// Remove removes the element "e" from the List.
+//
+// It returns true if the element has been removed, or false if it is nil or
+// not an element of the List (e.g. it has already been removed or popped).
+func (l *ListOf[T]) Remove(e *ElementOf[T]) bool {
+	if e == nil {
+		return false
+	}
 	l.mu.Lock()
-	n := l.tail
-	c := l.length - 1
-	for n != nil {
-		if !f(c, n.value) {
-			l.mu.Unlock()
-			return
-		}
-		c -= 1
-		n = n.prev
+	defer l.mu.Unlock()
+	if e.list.Load() != l {
+		return false
 	}
-	l.mu.Unlock()
+	l.unlink(e)
+	return true
 }
 
 // RPop removes the right-most node from the List (i.e. the tail), and returns
-// it's value.
-func (l *List) RPop() interface{} {
+// it's value. If the List is empty, the zero value of T (nil for List) is
+// returned.
+func (l *ListOf[T]) RPop() T {
 	// lock the list, unlock on return
 	l.mu.Lock()
 	// retrieve tail
 	if t := l.tail; t != nil {
+		t.list.Store(nil)
 		if l.length == 1 {
 			l.length = 0
 			l.tail = nil
 			l.head = nil
+			l.notify()
 			l.mu.Unlock()
-			return t.value
+			return t.Value
 		}
 		l.length -= 1
 		l.tail = t.prev
 		l.tail.next = nil
+		l.notify()
 		l.mu.Unlock()
-		return t.value
+		return t.Value
 	}
 	l.mu.Unlock()
-	return nil
+	var zero T
+	return zero
 }
 
 // RPush inserts the provided value to the right-most position in the list (the
-// tail position).
-func (l *List) RPush(v interface{}) {
-	// create new node
-	n := &lnode{
-		value: v,
-	}
-	// lock the list, unlock on return
+// tail position). If the List is full or closed, the value is not inserted;
+// use PushBack to find out.
+func (l *ListOf[T]) RPush(v T) {
+	l.PushBack(v)
+}
+
+// Snapshot returns a copy of the values in the List, from the left-most node
+// (the head) to the right-most node (the tail).
+func (l *ListOf[T]) Snapshot() []T {
 	l.mu.Lock()
-	// add node to tail
-	l.length += 1
-	if t := l.tail; t != nil {
-		n.prev = t
-		t.next = n
-		l.tail = n
-		l.mu.Unlock()
-		return
+	defer l.mu.Unlock()
+	vals := make([]T, 0, l.length)
+	for n := l.head; n != nil; n = n.next {
+		vals = append(vals, n.Value)
 	}
-	// list is empty, assign node to head & tail
-	l.head = n
-	l.tail = n
-	l.mu.Unlock()
+	return vals
 }
 
 // ValueAt returns the value of the node at position "i". If the provided
-// position is not in the bounds of the List, nil is returned.
-func (l *List) ValueAt(i int) interface{} {
+// position is not in the bounds of the List, the zero value of T (nil for List)
+// is returned.
+func (l *ListOf[T]) ValueAt(i int) T {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	if i >= l.length || i < 0 {
-		return nil
+		var zero T
+		return zero
 	}
 	var c int
 	n := l.head
 	for {
 		if c == i {
-			return n.value
+			return n.Value
 		}
 		n = n.next
 		c += 1
 	}
 }
+
+// insert links the element "n" into the List immediately after the element
+// "at", or at the head position if "at" is nil. The caller must hold l.mu.
+func (l *ListOf[T]) insert(n, at *ElementOf[T]) *ElementOf[T] {
+	n.list.Store(l)
+	n.prev = at
+	if at == nil {
+		n.next = l.head
+		l.head = n
+	} else {
+		n.next = at.next
+		at.next = n
+	}
+	if n.next == nil {
+		l.tail = n
+	} else {
+		n.next.prev = n
+	}
+	l.length += 1
+	l.notify()
+	return n
+}
+
+// unlink removes the element "n" from the List. The caller must hold l.mu.
+func (l *ListOf[T]) unlink(n *ElementOf[T]) {
+	if n.prev == nil {
+		l.head = n.next
+	} else {
+		n.prev.next = n.next
+	}
+	if n.next == nil {
+		l.tail = n.prev
+	} else {
+		n.next.prev = n.prev
+	}
+	n.next = nil
+	n.prev = nil
+	n.list.Store(nil)
+	l.length -= 1
+	l.notify()
+}
+
+// bpop removes the left-most (or right-most) node from the List, blocking
+// until an item is available.
+func (l *ListOf[T]) bpop(ctx context.Context, left bool) (T, error) {
+	for {
+		l.mu.Lock()
+		if l.length > 0 {
+			n := l.tail
+			if left {
+				n = l.head
+			}
+			l.unlink(n)
+			l.mu.Unlock()
+			return n.Value, nil
+		}
+		if l.closed {
+			l.mu.Unlock()
+			var zero T
+			return zero, ErrListClosed
+		}
+		ch := l.wait()
+		l.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// bpush inserts the provided value to the left-most (or right-most) position
+// in the List, blocking until there is room.
+func (l *ListOf[T]) bpush(ctx context.Context, v T, left bool) (*ElementOf[T], error) {
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, ErrListClosed
+		}
+		if !l.full() {
+			at := l.tail
+			if left {
+				at = nil
+			}
+			n := l.insert(&ElementOf[T]{Value: v}, at)
+			l.mu.Unlock()
+			return n, nil
+		}
+		ch := l.wait()
+		l.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// full returns true if no more items can be added to the List, because it is
+// bounded and full, or closed. The caller must hold l.mu.
+func (l *ListOf[T]) full() bool {
+	return l.closed || (l.max > 0 && l.length >= l.max)
+}
+
+// wait returns a channel that is closed the next time the List changes. The
+// caller must hold l.mu.
+func (l *ListOf[T]) wait() chan struct{} {
+	if l.signal == nil {
+		l.signal = make(chan struct{})
+	}
+	return l.signal
+}
+
+// notify wakes all goroutines waiting for the List to change. The caller must
+// hold l.mu.
+func (l *ListOf[T]) notify() {
+	if l.signal != nil {
+		close(l.signal)
+		l.signal = nil
+	}
+}
+
+// walk calls "f" with each element in the List, starting from the head if
+// "forward" is true or the tail otherwise, without holding l.mu while "f"
+// runs.
+//
+// The elements are collected before iterating, so that "f" may remove any of
+// them, including the ones that follow. Elements removed before they are
+// reached are skipped.
+func (l *ListOf[T]) walk(forward bool, f func(int, *ElementOf[T], T) bool) {
+	l.mu.Lock()
+	elems := make([]*ElementOf[T], 0, l.length)
+	for n := l.head; n != nil; n = n.next {
+		elems = append(elems, n)
+	}
+	l.mu.Unlock()
+	c, step := 0, 1
+	if !forward {
+		c, step = len(elems)-1, -1
+	}
+	for i := range elems {
+		n := elems[i]
+		if !forward {
+			n = elems[len(elems)-1-i]
+		}
+		l.mu.Lock()
+		if n.list.Load() != l {
+			// the element has been removed, skip it
+			l.mu.Unlock()
+			continue
+		}
+		v := n.Value
+		l.mu.Unlock()
+		if !f(c, n, v) {
+			return
+		}
+		c += step
+	}
+}
@@ -23,8 +23,10 @@
 package ratelim
 
 import (
+	"context"
 	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -82,6 +84,159 @@ func TestListR(t *testing.T) {
 	}
 }
 
+func TestListOf(t *testing.T) {
+	l := NewListOf[int]()
+	l.RPush(1)
+	l.RPush(2)
+	l.LPush(0)
+	var sum int
+	l.LEach(func(i, v int) bool {
+		if i != v {
+			t.Error("Incorrect value at index", i)
+		}
+		sum += v
+		return true
+	})
+	if sum != 3 {
+		t.Error("LEach did not visit every value")
+	}
+	if l.LPop() != 0 || l.RPop() != 2 || l.RPop() != 1 {
+		t.Error("Incorrect values popped from ListOf")
+	}
+	if l.LPop() != 0 {
+		t.Error("LPop on empty ListOf should return the zero value")
+	}
+}
+
+func TestListElements(t *testing.T) {
+	l := NewListOf[string]()
+	e1 := l.PushBack("Val1")
+	e3 := l.PushBack("Val3")
+	e2 := l.InsertBefore("Val2", e3)
+	e0 := l.InsertAfter("Val0", e3)
+	if l.Len() != 4 {
+		t.Error("Incorrect length after inserts:", l.Len())
+	}
+	l.MoveToFront(e0)
+	l.MoveToBack(e1)
+	want := []string{"Val0", "Val2", "Val3", "Val1"}
+	l.LEach(func(i int, v string) bool {
+		if v != want[i] {
+			t.Error("Incorrect value at index", i, v)
+		}
+		return true
+	})
+	if l.Front() != e0 || l.Back() != e1 || e0.Next() != e2 || e1.Prev() != e3 {
+		t.Error("Incorrect element links after moves")
+	}
+	if !l.Remove(e2) || l.Remove(e2) {
+		t.Error("Remove returned an incorrect value")
+	}
+	if l.RPop() != "Val1" || l.InsertAfter("Val4", e1) != nil {
+		t.Error("Popped elements should no longer belong to the list")
+	}
+	if l.Len() != 2 || l.ValueAt(1) != "Val3" {
+		t.Error("Incorrect list contents after Remove")
+	}
+}
+
+func TestListBlockingPop(t *testing.T) {
+	l := NewListOf[string]()
+	ch := make(chan string, 1)
+	go func() {
+		v, err := l.BLPop(context.Background())
+		if err != nil {
+			t.Error("BLPop returned an error:", err)
+		}
+		ch <- v
+	}()
+	time.Sleep(time.Millisecond * 10)
+	l.RPush("Val1")
+	if v := <-ch; v != "Val1" {
+		t.Error("BLPop returned an incorrect value:", v)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := l.BRPop(ctx); err != context.DeadlineExceeded {
+		t.Error("BRPop should return the context error:", err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.BRPop(context.Background())
+		errs <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	l.Close()
+	if err := <-errs; err != ErrListClosed {
+		t.Error("Close should wake blocked consumers:", err)
+	}
+}
+
+func TestListBounded(t *testing.T) {
+	l := NewBoundedListOf[int](2)
+	l.RPush(1)
+	e := l.PushBack(2)
+	if l.PushFront(3) != nil || l.InsertAfter(3, e) != nil {
+		t.Error("Pushes should fail on a full list")
+	}
+	done := make(chan struct{})
+	go func() {
+		if _, err := l.BRPush(context.Background(), 3); err != nil {
+			t.Error("BRPush returned an error:", err)
+		}
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	if l.LPop() != 1 {
+		t.Error("LPop returned an incorrect value")
+	}
+	<-done
+	if l.Len() != 2 || l.RPop() != 3 {
+		t.Error("BRPush should add the value once there is room")
+	}
+	l.Close()
+	if l.PushBack(4) != nil || l.RPop() != 2 {
+		t.Error("Closed list should reject pushes but allow pops")
+	}
+}
+
+func TestListIterators(t *testing.T) {
+	l := NewListOf[int]()
+	for i := 0; i < 5; i++ {
+		l.RPush(i)
+	}
+	for i, v := range l.All() {
+		if i != v {
+			t.Error("All returned an incorrect value at index", i, v)
+		}
+	}
+	for i, v := range l.Backward() {
+		if i != v {
+			t.Error("Backward returned an incorrect value at index", i, v)
+		}
+	}
+	// modifying the list while iterating must not deadlock
+	for e := range l.Elements() {
+		if e.Value%2 == 1 {
+			l.Remove(e)
+		}
+	}
+	l.LEach(func(i, v int) bool {
+		l.RPush(v * 10)
+		return i < 1
+	})
+	snap := l.Snapshot()
+	want := []int{0, 2, 4, 0, 20}
+	if len(snap) != len(want) {
+		t.Fatal("Incorrect snapshot:", snap)
+	}
+	for i := range want {
+		if snap[i] != want[i] {
+			t.Error("Incorrect snapshot:", snap)
+		}
+	}
+}
+
 func BenchmarkListLPush(b *testing.B) {
 	l := &List{
 		mu: sync.Mutex{},
@@ -107,3 +262,64 @@ func BenchmarkListLPop(b *testing.B) {
 	if v == "hello" {
 	}
 }
+
+func TestListNilElement(t *testing.T) {
+	l := NewListOf[int]()
+	l.RPush(1)
+	l.MoveToFront(nil)
+	l.MoveToBack(nil)
+	if l.Remove(nil) || l.Len() != 1 {
+		t.Error("Nil elements should not modify the list")
+	}
+}
+
+func TestListElementConcurrent(t *testing.T) {
+	l := NewListOf[int]()
+	elems := make([]*ElementOf[int], 100)
+	for i := range elems {
+		elems[i] = l.PushBack(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, e := range elems {
+			e.Next()
+			e.Prev()
+		}
+	}()
+	for _, e := range elems {
+		l.Remove(e)
+	}
+	<-done
+}
+
+func TestListAllRemove(t *testing.T) {
+	l := NewListOf[int]()
+	var elems []*ElementOf[int]
+	for i := 0; i < 6; i++ {
+		elems = append(elems, l.PushBack(i))
+	}
+	var got []int
+	for _, v := range l.All() {
+		got = append(got, v)
+		if v == 0 {
+			// remove the current element and the one after it
+			l.Remove(elems[0])
+			l.Remove(elems[1])
+		}
+	}
+	if len(got) != 5 || got[0] != 0 || got[1] != 2 || got[4] != 5 {
+		t.Error("Incorrect values visited:", got)
+	}
+	got = got[:0]
+	for _, v := range l.Backward() {
+		got = append(got, v)
+		if v == 5 {
+			l.Remove(elems[5])
+			l.Remove(elems[4])
+		}
+	}
+	if len(got) != 3 || got[0] != 5 || got[1] != 3 || got[2] != 2 {
+		t.Error("Incorrect values visited backward:", got)
+	}
+}
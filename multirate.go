@@ -0,0 +1,264 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate is a single rule of a MultiRateOf: at most Limit events per Period.
+type Rate struct {
+	// Limit is the maximum number of events per period
+	Limit int64
+	// Period is the length of the window
+	Period time.Duration
+}
+
+// String returns the rate in the form "limit/period", e.g. "10/1s".
+func (r Rate) String() string {
+	return strconv.FormatInt(r.Limit, 10) + "/" + r.Period.String()
+}
+
+// RateLimitError is returned when an event is denied by one of the rules of a
+// MultiRateOf. It implements the RetryAfter method, so that Retry waits until
+// the rule allows events again.
+type RateLimitError struct {
+	// Rule is the rule that denied the event
+	Rule Rate
+	// Index is the position of the rule in the MultiRateOf
+	Index int
+	// Wait is the duration until the rule's window ends
+	Wait time.Duration
+}
+
+// Error returns the error message, naming the rule that denied the event.
+func (e *RateLimitError) Error() string {
+	return "ratelim: rate limit " + e.Rule.String() + " exceeded"
+}
+
+// RetryAfter returns the duration until the rule's window ends.
+func (e *RateLimitError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// Unwrap returns ErrLimited, so that errors.Is(err, ErrLimited) is true.
+func (e *RateLimitError) Unwrap() error {
+	return ErrLimited
+}
+
+// rateWindow is the count for a single rule in a multiRateEntry.
+type rateWindow struct {
+	// count is the number of events in the current window
+	count int64
+	// expires is the time the current window ends
+	expires time.Time
+}
+
+// multiRateEntry holds the windows of a single key, one per rule.
+type multiRateEntry []rateWindow
+
+// MultiRateOf limits the number of events per key of type K according to
+// several rates at once, e.g. 10 per second and 1000 per hour.
+//
+// All rules are checked together: an event is only counted if every rule
+// allows it. As with LimiterOf, each key has its own windows, which start with
+// the key's first event.
+type MultiRateOf[K comparable] struct {
+	// rules holds the rates to apply
+	rules []Rate
+	// mu is the mutex for accessing cache and closed
+	mu sync.Mutex
+	// cache holds the windows of each key
+	cache map[K]multiRateEntry
+	// ticker is the timer that removes expired keys
+	ticker *time.Ticker
+	// cch is the channel that listens for a close event
+	cch chan struct{}
+	// closed indicates whether the limiter is closed
+	closed bool
+}
+
+// MultiRate is a MultiRateOf with string keys.
+type MultiRate = MultiRateOf[string]
+
+// NewMultiRate returns an initialized MultiRate pointer applying every rule in
+// "rules". See NewMultiRateOf for more information.
+func NewMultiRate(rules ...Rate) *MultiRate {
+	return NewMultiRateOf[string](rules...)
+}
+
+// NewMultiRateOf returns an initialized MultiRateOf pointer applying every
+// rule in "rules". Rules with a period smaller than 1 are ignored.
+//
+// Close must be called to stop the internal timer once the limiter will no
+// longer be used.
+func NewMultiRateOf[K comparable](rules ...Rate) *MultiRateOf[K] {
+	var valid []Rate
+	sweep := time.Second
+	for _, r := range rules {
+		if r.Period > 0 {
+			valid = append(valid, r)
+			sweep = max(sweep, r.Period)
+		}
+	}
+	lim := &MultiRateOf[K]{
+		rules:  valid,
+		cache:  make(map[K]multiRateEntry),
+		ticker: time.NewTicker(sweep),
+		cch:    make(chan struct{}, 1),
+	}
+	go lim.tick()
+	return lim
+}
+
+func (lim *MultiRateOf[K]) tick() {
+	for {
+		select {
+		case <-lim.ticker.C:
+			lim.sweep()
+		case <-lim.cch:
+			lim.ticker.Stop()
+			return
+		}
+	}
+}
+
+// Close stops the internal ticker that removes expired keys. Like
+// LimiterOf.Close, it has no effect if the limiter has already been closed.
+func (lim *MultiRateOf[K]) Close() {
+	lim.mu.Lock()
+	if lim.closed {
+		lim.mu.Unlock()
+		return
+	}
+	lim.closed = true
+	lim.mu.Unlock()
+	lim.cch <- struct{}{}
+}
+
+// IsClosed returns true if the limiter has been closed. It returns false if it
+// is still open.
+func (lim *MultiRateOf[K]) IsClosed() bool {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.closed
+}
+
+// Rules returns a copy of the rules applied by the limiter.
+func (lim *MultiRateOf[K]) Rules() []Rate {
+	return append([]Rate(nil), lim.rules...)
+}
+
+// Capacity returns the smallest limit of all rules, which is the largest value
+// that can be added at once, or math.MaxInt64 if there are no rules.
+func (lim *MultiRateOf[K]) Capacity() int64 {
+	c := int64(math.MaxInt64)
+	for _, r := range lim.rules {
+		c = min(c, r.Limit)
+	}
+	return c
+}
+
+// Allow records a single event for "key". See AllowN for more information.
+func (lim *MultiRateOf[K]) Allow(key K) error {
+	return lim.AllowN(key, 1)
+}
+
+// AllowN records an event of "n" for "key" if every rule allows it.
+//
+// It returns nil if the event is allowed. If "n" is larger than the limit of
+// any rule, ErrTooLarge is returned. Otherwise, if any rule denies the event, a
+// *RateLimitError is returned for the rule that will deny it the longest, and
+// the event is not counted by any rule.
+func (lim *MultiRateOf[K]) AllowN(key K, n int64) error {
+	if n < 1 {
+		return nil
+	}
+	if n > lim.Capacity() {
+		return ErrTooLarge
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	now := time.Now()
+	e, ok := lim.cache[key]
+	if !ok {
+		e = make(multiRateEntry, len(lim.rules))
+		lim.cache[key] = e
+	}
+	var err *RateLimitError
+	for i, r := range lim.rules {
+		w := &e[i]
+		if !now.Before(w.expires) {
+			// no current window for the rule, start a new one
+			w.count = 0
+			w.expires = now.Add(r.Period)
+		}
+		if w.count+n > r.Limit {
+			if wait := w.expires.Sub(now); err == nil || wait > err.Wait {
+				err = &RateLimitError{Rule: r, Index: i, Wait: wait}
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for i := range e {
+		e[i].count += n
+	}
+	return nil
+}
+
+// IncBy records an event of "val" for "key", returning true if it is allowed
+// by every rule. It allows a MultiRateOf to be used as a KeyLimiter.
+func (lim *MultiRateOf[K]) IncBy(key K, val int64) bool {
+	return lim.AllowN(key, val) == nil
+}
+
+// Clear resets the counts for "key".
+func (lim *MultiRateOf[K]) Clear(key K) {
+	lim.mu.Lock()
+	delete(lim.cache, key)
+	lim.mu.Unlock()
+}
+
+// sweep removes the keys whose windows have all ended.
+func (lim *MultiRateOf[K]) sweep() {
+	lim.mu.Lock()
+	now := time.Now()
+	for key, e := range lim.cache {
+		expired := true
+		for _, w := range e {
+			if now.Before(w.expires) {
+				expired = false
+				break
+			}
+		}
+		if expired {
+			delete(lim.cache, key)
+		}
+	}
+	lim.mu.Unlock()
+}
@@ -0,0 +1,100 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMultiRateAllow(t *testing.T) {
+	lim := NewMultiRate(Rate{Limit: 2, Period: 50 * time.Millisecond}, Rate{Limit: 3, Period: time.Hour})
+	defer lim.Close()
+	if lim.Allow("sample1") != nil || lim.Allow("sample1") != nil {
+		t.Error("Events within all rules should be allowed")
+	}
+	err := lim.Allow("sample1")
+	var rerr *RateLimitError
+	if !errors.As(err, &rerr) || rerr.Index != 0 || rerr.RetryAfter() > 50*time.Millisecond {
+		t.Error("Expected the first rule to deny:", err)
+	}
+	if !errors.Is(err, ErrLimited) {
+		t.Error("RateLimitError should match ErrLimited")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if lim.Allow("sample1") != nil {
+		t.Error("Event should be allowed once the first window ends")
+	}
+	err = lim.Allow("sample1")
+	if !errors.As(err, &rerr) || rerr.Index != 1 || rerr.RetryAfter() < 50*time.Minute {
+		t.Error("Expected the second rule to deny:", err)
+	}
+	if rerr.Error() != "ratelim: rate limit 3/1h0m0s exceeded" {
+		t.Error("Incorrect error message:", rerr)
+	}
+	if lim.Allow("sample2") != nil {
+		t.Error("Other keys should be allowed")
+	}
+}
+
+func TestMultiRateAtomic(t *testing.T) {
+	lim := NewMultiRateOf[int](Rate{Limit: 10, Period: time.Hour}, Rate{Limit: 5, Period: time.Hour})
+	defer lim.Close()
+	if lim.AllowN(1, 6) != ErrTooLarge {
+		t.Error("Expected ErrTooLarge above the smallest limit")
+	}
+	lim.AllowN(1, 4)
+	if lim.AllowN(1, 2) == nil {
+		t.Error("Second rule should deny")
+	}
+	// the denied event must not have been counted by the first rule
+	lim.rules[1].Limit = 10
+	if lim.AllowN(1, 6) != nil {
+		t.Error("Denied events should not be counted")
+	}
+}
+
+func TestMultiRateRetry(t *testing.T) {
+	lim := NewMultiRate(Rate{Limit: 1, Period: 30 * time.Millisecond})
+	defer lim.Close()
+	start := time.Now()
+	err := Retry(context.Background(), func(context.Context) error {
+		return lim.Allow("sample1")
+	}, RetryPolicy{MaxAttempts: 3, Base: time.Millisecond})
+	if err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if lim.Allow("sample1") == nil {
+		t.Error("Second event should be denied")
+	}
+	if err := Retry(context.Background(), func(context.Context) error {
+		return lim.Allow("sample1")
+	}, RetryPolicy{MaxAttempts: 3, Base: time.Millisecond}); err != nil {
+		t.Error("Retry should wait for the window to end:", err)
+	}
+	if dur := time.Since(start); dur < 25*time.Millisecond {
+		t.Error("Retry did not honor the retry-after duration:", dur)
+	}
+}
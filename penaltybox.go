@@ -0,0 +1,400 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// KeyLimiter is implemented by the keyed limiters in this package (LimiterOf,
+// ShardedLimiterOf and SketchLimiterOf), and can be implemented by any other
+// limiter that counts events per key.
+type KeyLimiter[K comparable] interface {
+	// IncBy increments the count for "key" by "val", returning false if the
+	// event is not allowed.
+	IncBy(key K, val int64) bool
+}
+
+// penalty is the violation history for a single key in a PenaltyBox.
+type penalty struct {
+	// violations is the number of violations since the last ban
+	violations int
+	// bans is the number of bans applied, used to escalate the next one
+	bans int
+	// last is the time of the last violation or ban
+	last time.Time
+	// until is the time the current ban ends
+	until time.Time
+}
+
+// forgotten returns true if the history of the penalty has been forgotten by
+// "now": no violation or ban within "forget" of either its last violation or the
+// end of its last ban, whichever is later.
+func (p *penalty) forgotten(now time.Time, forget time.Duration) bool {
+	since := p.last
+	if p.until.After(since) {
+		since = p.until
+	}
+	return now.Sub(since) > forget
+}
+
+// PenaltyBox wraps a KeyLimiter, temporarily banning keys that repeatedly
+// exceed its limits.
+//
+// Each time the wrapped limiter denies an event, it counts as a violation for
+// the key. Every "threshold" violations, the key is banned: all of its events
+// are denied, without reaching the wrapped limiter, for the next duration of
+// the escalation. Each subsequent ban uses the next (usually longer) duration,
+// and the last one is repeated once the escalation is exhausted. A key's
+// history is forgotten once it has gone without a violation, measured from the
+// end of its last ban, for the longest duration of the escalation.
+//
+// Keys can also be banned manually, and allowed or denied permanently, either
+// by key or, for keys holding an IP address (netip.Addr, netip.Prefix or a
+// string), by CIDR prefix. Deny lists take precedence over allow lists.
+type PenaltyBox[K comparable] struct {
+	// lim is the wrapped limiter
+	lim KeyLimiter[K]
+	// threshold is the number of violations that triggers a ban
+	threshold int
+	// escalation is the duration of each successive ban
+	escalation []time.Duration
+	// forget is how long a key's history is kept after its last violation or
+	// the end of its last ban
+	forget time.Duration
+	// mu is the mutex for accessing penalties and the allow/deny lists
+	mu sync.Mutex
+	// penalties holds the violation history for each key
+	penalties map[K]*penalty
+	// allowKeys holds the keys that are never limited
+	allowKeys map[K]struct{}
+	// denyKeys holds the keys that are always denied
+	denyKeys map[K]struct{}
+	// allowNets holds the prefixes that are never limited
+	allowNets prefixSet
+	// denyNets holds the prefixes that are always denied
+	denyNets prefixSet
+	// ticker is the timer that removes forgotten keys
+	ticker *time.Ticker
+	// cch is the channel that listens for a close event
+	cch chan struct{}
+	// closed indicates whether the penalty box is closed
+	closed bool
+}
+
+// NewPenaltyBox returns an initialized PenaltyBox pointer wrapping "lim", that
+// bans a key every "threshold" violations for the successive durations in
+// "escalation". If "threshold" is smaller than 1, the value 1 will be used. If
+// no escalation is provided, bans of 1 minute, 10 minutes and 1 hour are used.
+//
+// Close must be called to stop the internal timer once the penalty box will no
+// longer be used.
+func NewPenaltyBox[K comparable](lim KeyLimiter[K], threshold int, escalation ...time.Duration) *PenaltyBox[K] {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if len(escalation) == 0 {
+		escalation = []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
+	}
+	var forget time.Duration
+	for _, d := range escalation {
+		forget = max(forget, d)
+	}
+	if forget <= 0 {
+		forget = time.Minute
+	}
+	pb := &PenaltyBox[K]{
+		lim:        lim,
+		threshold:  threshold,
+		escalation: escalation,
+		forget:     forget,
+		penalties:  make(map[K]*penalty),
+		allowKeys:  make(map[K]struct{}),
+		denyKeys:   make(map[K]struct{}),
+		ticker:     time.NewTicker(forget),
+		cch:        make(chan struct{}, 1),
+	}
+	go pb.tick()
+	return pb
+}
+
+func (pb *PenaltyBox[K]) tick() {
+	for {
+		select {
+		case <-pb.ticker.C:
+			pb.sweep()
+		case <-pb.cch:
+			pb.ticker.Stop()
+			return
+		}
+	}
+}
+
+// Close stops the internal ticker that removes forgotten keys. It does not
+// close the wrapped limiter. Like LimiterOf.Close, it has no effect if the
+// penalty box has already been closed.
+func (pb *PenaltyBox[K]) Close() {
+	pb.mu.Lock()
+	if pb.closed {
+		pb.mu.Unlock()
+		return
+	}
+	pb.closed = true
+	pb.mu.Unlock()
+	pb.cch <- struct{}{}
+}
+
+// IsClosed returns true if the penalty box has been closed. It returns false if
+// it is still open.
+func (pb *PenaltyBox[K]) IsClosed() bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return pb.closed
+}
+
+// Capacity returns the capacity of the wrapped limiter, or math.MaxInt64 if it
+// is unknown.
+func (pb *PenaltyBox[K]) Capacity() int64 {
+	return capacity(pb.lim)
+}
+
+// Inc records a single event for "key". See IncBy for more information.
+func (pb *PenaltyBox[K]) Inc(key K) bool {
+	return pb.IncBy(key, 1)
+}
+
+// IncBy records an event of "val" for "key". It returns false if the key is
+// denied or banned, or if the wrapped limiter denies the event (which counts
+// as a violation). Allowed keys always return true, without reaching the
+// wrapped limiter.
+func (pb *PenaltyBox[K]) IncBy(key K, val int64) bool {
+	now := time.Now()
+	pb.mu.Lock()
+	if ok, listed := pb.listed(key); listed {
+		pb.mu.Unlock()
+		return ok
+	}
+	if p, ok := pb.penalties[key]; ok && now.Before(p.until) {
+		pb.mu.Unlock()
+		return false
+	}
+	pb.mu.Unlock()
+
+	if pb.lim.IncBy(key, val) {
+		return true
+	}
+
+	pb.mu.Lock()
+	p, ok := pb.penalties[key]
+	if !ok || p.forgotten(now, pb.forget) {
+		p = &penalty{}
+		pb.penalties[key] = p
+	}
+	p.last = now
+	p.violations += 1
+	if p.violations >= pb.threshold {
+		p.violations = 0
+		p.until = now.Add(pb.escalation[min(p.bans, len(pb.escalation)-1)])
+		p.bans += 1
+	}
+	pb.mu.Unlock()
+	return false
+}
+
+// Ban bans "key" for the duration "dur", replacing any current ban. Manual bans
+// do not count towards the escalation.
+func (pb *PenaltyBox[K]) Ban(key K, dur time.Duration) {
+	now := time.Now()
+	pb.mu.Lock()
+	p, ok := pb.penalties[key]
+	if !ok {
+		p = &penalty{}
+		pb.penalties[key] = p
+	}
+	p.last = now
+	p.until = now.Add(dur)
+	pb.mu.Unlock()
+}
+
+// Unban lifts any ban on "key" and forgets its violation history.
+func (pb *PenaltyBox[K]) Unban(key K) {
+	pb.mu.Lock()
+	delete(pb.penalties, key)
+	pb.mu.Unlock()
+}
+
+// BannedUntil returns the time the current ban on "key" ends, and true if the
+// key is currently banned. Keys on the deny list are not reported.
+func (pb *PenaltyBox[K]) BannedUntil(key K) (time.Time, bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if p, ok := pb.penalties[key]; ok && time.Now().Before(p.until) {
+		return p.until, true
+	}
+	return time.Time{}, false
+}
+
+// Allow adds "key" to the allow list, so that it is never limited.
+func (pb *PenaltyBox[K]) Allow(key K) {
+	pb.mu.Lock()
+	pb.allowKeys[key] = struct{}{}
+	pb.mu.Unlock()
+}
+
+// Deny adds "key" to the deny list, so that all of its events are denied.
+func (pb *PenaltyBox[K]) Deny(key K) {
+	pb.mu.Lock()
+	pb.denyKeys[key] = struct{}{}
+	pb.mu.Unlock()
+}
+
+// AllowPrefix adds "prefix" to the allow list, so that keys holding an address
+// within it are never limited.
+func (pb *PenaltyBox[K]) AllowPrefix(prefix netip.Prefix) {
+	pb.mu.Lock()
+	pb.allowNets.add(prefix)
+	pb.mu.Unlock()
+}
+
+// DenyPrefix adds "prefix" to the deny list, so that all events for keys
+// holding an address within it are denied.
+func (pb *PenaltyBox[K]) DenyPrefix(prefix netip.Prefix) {
+	pb.mu.Lock()
+	pb.denyNets.add(prefix)
+	pb.mu.Unlock()
+}
+
+// Remove removes "key" from both the allow and deny lists.
+func (pb *PenaltyBox[K]) Remove(key K) {
+	pb.mu.Lock()
+	delete(pb.allowKeys, key)
+	delete(pb.denyKeys, key)
+	pb.mu.Unlock()
+}
+
+// RemovePrefix removes "prefix" from both the allow and deny lists.
+func (pb *PenaltyBox[K]) RemovePrefix(prefix netip.Prefix) {
+	pb.mu.Lock()
+	pb.allowNets.remove(prefix)
+	pb.denyNets.remove(prefix)
+	pb.mu.Unlock()
+}
+
+// listed returns whether "key" is allowed, and true if it is on either the
+// allow or the deny list. The caller must hold pb.mu.
+func (pb *PenaltyBox[K]) listed(key K) (bool, bool) {
+	if _, ok := pb.denyKeys[key]; ok {
+		return false, true
+	}
+	if _, ok := pb.allowKeys[key]; ok {
+		return true, true
+	}
+	if pb.denyNets.empty() && pb.allowNets.empty() {
+		return false, false
+	}
+	addr, ok := keyAddr(key)
+	if !ok {
+		return false, false
+	}
+	if pb.denyNets.contains(addr) {
+		return false, true
+	}
+	if pb.allowNets.contains(addr) {
+		return true, true
+	}
+	return false, false
+}
+
+// sweep removes the keys that are not banned and whose history has been
+// forgotten.
+func (pb *PenaltyBox[K]) sweep() {
+	now := time.Now()
+	pb.mu.Lock()
+	for key, p := range pb.penalties {
+		if p.forgotten(now, pb.forget) {
+			delete(pb.penalties, key)
+		}
+	}
+	pb.mu.Unlock()
+}
+
+// keyAddr returns the IP address held by "key", if it is a netip.Addr, a
+// netip.Prefix or a string holding an IP address.
+func keyAddr[K comparable](key K) (netip.Addr, bool) {
+	switch k := any(key).(type) {
+	case netip.Addr:
+		return k, k.IsValid()
+	case netip.Prefix:
+		return k.Addr(), k.IsValid()
+	case string:
+		addr, err := netip.ParseAddr(k)
+		return addr, err == nil
+	}
+	return netip.Addr{}, false
+}
+
+// prefixSet is a set of CIDR prefixes.
+type prefixSet struct {
+	// prefixes holds the prefixes in the set
+	prefixes []netip.Prefix
+}
+
+// add adds "prefix" to the set, masking any host bits.
+func (ps *prefixSet) add(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	for _, p := range ps.prefixes {
+		if p == prefix {
+			return
+		}
+	}
+	ps.prefixes = append(ps.prefixes, prefix)
+}
+
+// remove removes "prefix" from the set.
+func (ps *prefixSet) remove(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	for i, p := range ps.prefixes {
+		if p == prefix {
+			ps.prefixes = append(ps.prefixes[:i], ps.prefixes[i+1:]...)
+			return
+		}
+	}
+}
+
+// contains returns true if "addr" is within any prefix in the set.
+func (ps *prefixSet) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range ps.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// empty returns true if the set holds no prefixes.
+func (ps *prefixSet) empty() bool {
+	return len(ps.prefixes) == 0
+}
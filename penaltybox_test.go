@@ -0,0 +1,125 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPenaltyBoxEscalation(t *testing.T) {
+	lim := NewLimiter(1, time.Hour)
+	defer lim.Close()
+	pb := NewPenaltyBox[string](lim, 2, 50*time.Millisecond, time.Hour)
+	defer pb.Close()
+	if !pb.Inc("sample1") {
+		t.Error("First event should be allowed")
+	}
+	pb.Inc("sample1")
+	if _, ok := pb.BannedUntil("sample1"); ok {
+		t.Error("Key should not be banned after a single violation")
+	}
+	pb.Inc("sample1")
+	until, ok := pb.BannedUntil("sample1")
+	if !ok || time.Until(until) > 50*time.Millisecond {
+		t.Error("Key should be banned for the first duration:", until)
+	}
+	lim.Clear("sample1")
+	if pb.Inc("sample1") {
+		t.Error("Banned key should be denied")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !pb.Inc("sample1") {
+		t.Error("Key should be allowed once the ban ends")
+	}
+	pb.Inc("sample1")
+	pb.Inc("sample1")
+	if until, ok := pb.BannedUntil("sample1"); !ok || time.Until(until) < time.Minute {
+		t.Error("Second ban should escalate:", until)
+	}
+	pb.Unban("sample1")
+	if _, ok := pb.BannedUntil("sample1"); ok {
+		t.Error("Unban should lift the ban")
+	}
+}
+
+func TestPenaltyBoxRepeatLastBan(t *testing.T) {
+	lim := NewLimiter(0, time.Hour)
+	defer lim.Close()
+	pb := NewPenaltyBox[string](lim, 1, 20*time.Millisecond, 40*time.Millisecond)
+	defer pb.Close()
+	for i, want := range []time.Duration{20, 40, 40, 40} {
+		want *= time.Millisecond
+		start := time.Now()
+		pb.Inc("sample1")
+		until, ok := pb.BannedUntil("sample1")
+		if !ok {
+			t.Fatal("Key should be banned after a violation:", i)
+		}
+		if dur := until.Sub(start); dur < want || dur > want+10*time.Millisecond {
+			t.Errorf("Ban %d should last %v, got %v", i+1, want, dur)
+		}
+		time.Sleep(time.Until(until) + time.Millisecond)
+	}
+}
+
+func TestPenaltyBoxManualBan(t *testing.T) {
+	lim := NewLimiter(10, time.Hour)
+	defer lim.Close()
+	pb := NewPenaltyBox[string](lim, 1)
+	defer pb.Close()
+	pb.Ban("sample1", time.Hour)
+	if pb.Inc("sample1") {
+		t.Error("Banned key should be denied")
+	}
+	if !pb.Inc("sample2") {
+		t.Error("Other keys should be allowed")
+	}
+}
+
+func TestPenaltyBoxLists(t *testing.T) {
+	lim := NewLimiter(1, time.Hour)
+	defer lim.Close()
+	pb := NewPenaltyBox[string](lim, 1)
+	defer pb.Close()
+	pb.Allow("sample1")
+	pb.Deny("sample2")
+	pb.AllowPrefix(netip.MustParsePrefix("10.0.0.0/8"))
+	pb.DenyPrefix(netip.MustParsePrefix("2001:db8::/32"))
+	for i := 0; i < 3; i++ {
+		if !pb.Inc("sample1") || !pb.Inc("10.1.2.3") {
+			t.Error("Allowed keys should never be limited")
+		}
+	}
+	if pb.Inc("sample2") || pb.Inc("2001:db8::1") {
+		t.Error("Denied keys should always be denied")
+	}
+	pb.Remove("sample2")
+	if !pb.Inc("sample2") {
+		t.Error("Removed key should be allowed")
+	}
+	if lim.Len() != 1 {
+		t.Error("Listed keys should not reach the limiter")
+	}
+}
@@ -0,0 +1,502 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PolicySpec is the definition of a single policy in a policy config.
+//
+// A policy applies to every request whose attributes match all entries of
+// Match, where each value is a pattern as accepted by path.Match (e.g.
+// "/api/*"). It limits requests to Limit per Period, either per value of the
+// attribute Key, using a LimiterOf ("limiter", the default Type), or across
+// all requests, using a TBucket ("bucket") holding at most Burst tokens.
+type PolicySpec struct {
+	// Name is the unique name of the policy
+	Name string `json:"name"`
+	// Match holds the patterns that request attributes must match
+	Match map[string]string `json:"match,omitempty"`
+	// Key is the attribute whose value is used as the limiter key
+	Key string `json:"key,omitempty"`
+	// Type is the kind of limiter, "limiter" or "bucket"
+	Type string `json:"type,omitempty"`
+	// Limit is the number of requests allowed per period
+	Limit int64 `json:"limit"`
+	// Period is the window length, as accepted by time.ParseDuration
+	Period string `json:"period"`
+	// Burst is the bucket size of a "bucket" policy, Limit if zero
+	Burst int64 `json:"burst,omitempty"`
+}
+
+// PolicyError is returned when a policy config is invalid. It holds the line
+// of the config where the error was found.
+type PolicyError struct {
+	// Line is the line of the config where the error was found
+	Line int
+	// Policy is the name of the invalid policy, if known
+	Policy string
+	// Err is the underlying error
+	Err error
+}
+
+// Error returns the error message, including the line and policy name.
+func (e *PolicyError) Error() string {
+	msg := fmt.Sprintf("ratelim: policy config line %d", e.Line)
+	if e.Policy != "" {
+		msg += fmt.Sprintf(": policy %q", e.Policy)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// policy is a single policy built from a PolicySpec.
+type policy struct {
+	// spec is the definition of the policy
+	spec PolicySpec
+	// lim is the keyed limiter of a "limiter" policy
+	lim *LimiterOf[string]
+	// tb is the token bucket of a "bucket" policy
+	tb *TBucket
+}
+
+// matches returns true if "attrs" match all of the policy's patterns.
+func (p *policy) matches(attrs map[string]string) bool {
+	for attr, pattern := range p.spec.Match {
+		v, ok := attrs[attr]
+		if !ok {
+			return false
+		}
+		if ok, _ := path.Match(pattern, v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// applies returns true if the policy applies to a request with attributes
+// "attrs": they match all of its patterns, and hold its key if it has one.
+func (p *policy) applies(attrs map[string]string) bool {
+	if _, ok := attrs[p.spec.Key]; p.spec.Key != "" && !ok {
+		return false
+	}
+	return p.matches(attrs)
+}
+
+// allow records a request of "n" with attributes "attrs", returning false if
+// the policy denies it.
+func (p *policy) allow(attrs map[string]string, n int64) bool {
+	if p.tb != nil {
+		return p.tb.GetToks(n)
+	}
+	return p.lim.IncBy(attrs[p.spec.Key], n)
+}
+
+// refund gives back a request of "n" with attributes "attrs" that was allowed
+// by the policy.
+func (p *policy) refund(attrs map[string]string, n int64) {
+	if p.tb != nil {
+		p.tb.AddToks(n)
+		return
+	}
+	p.lim.DecBy(attrs[p.spec.Key], n)
+}
+
+// close stops the policy's internal timers.
+func (p *policy) close() {
+	if p.tb != nil {
+		p.tb.Close()
+	} else {
+		p.lim.Close()
+	}
+}
+
+// Policies is a set of rate limiting policies loaded from a JSON config, such
+// as:
+//
+//	{
+//		"policies": [
+//			{"name": "uploads", "match": {"route": "/api/upload"}, "key": "user", "limit": 5, "period": "1m"},
+//			{"name": "gold", "match": {"tier": "gold"}, "type": "bucket", "limit": 100, "period": "1s"}
+//		]
+//	}
+//
+// The config can be reloaded at any time; policies whose definition is
+// unchanged keep their state across reloads.
+type Policies struct {
+	// mu serializes reloads
+	mu sync.Mutex
+	// set holds the current policies
+	set atomic.Pointer[[]*policy]
+}
+
+// NewPolicies returns an initialized Policies pointer without any policy.
+func NewPolicies() *Policies {
+	ps := &Policies{}
+	ps.set.Store(&[]*policy{})
+	return ps
+}
+
+// LoadPolicies returns an initialized Policies pointer with the policies read
+// from "r". See Policies.Load for more information.
+func LoadPolicies(r io.Reader) (*Policies, error) {
+	ps := NewPolicies()
+	if err := ps.Load(r); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Load replaces the policies with the JSON config read from "r". If the config
+// is invalid, a *PolicyError is returned and the current policies are kept.
+func (ps *Policies) Load(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	specs, err := parsePolicies(data)
+	if err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	old := make(map[string]*policy)
+	for _, p := range *ps.set.Load() {
+		old[p.spec.Name] = p
+	}
+	set := make([]*policy, len(specs))
+	for i, spec := range specs {
+		if p, ok := old[spec.Name]; ok && reflect.DeepEqual(p.spec, spec) {
+			// unchanged, keep the current state
+			set[i] = p
+			delete(old, spec.Name)
+			continue
+		}
+		set[i] = newPolicy(spec)
+	}
+	ps.set.Store(&set)
+	for _, p := range old {
+		p.close()
+	}
+	return nil
+}
+
+// Specs returns the definitions of the current policies.
+func (ps *Policies) Specs() []PolicySpec {
+	set := *ps.set.Load()
+	specs := make([]PolicySpec, len(set))
+	for i, p := range set {
+		specs[i] = p.spec
+	}
+	return specs
+}
+
+// Allow records a single request with attributes "attrs". See AllowN for more
+// information.
+func (ps *Policies) Allow(attrs map[string]string) error {
+	return ps.AllowN(attrs, 1)
+}
+
+// AllowN records a request costing "n" with attributes "attrs" against every
+// matching policy, in the order of the config. Policies keyed by an attribute
+// that the request doesn't have don't apply.
+//
+// It returns nil if the request is allowed, or an error wrapping ErrLimited
+// and naming the first policy that denied it. A denied request is rolled back
+// from the policies that allowed it, so it isn't counted by any policy.
+func (ps *Policies) AllowN(attrs map[string]string, n int64) error {
+	set := *ps.set.Load()
+	for i, p := range set {
+		if !p.applies(attrs) {
+			continue
+		}
+		if !p.allow(attrs, n) {
+			for _, prev := range set[:i] {
+				if prev.applies(attrs) {
+					prev.refund(attrs, n)
+				}
+			}
+			return fmt.Errorf("ratelim: policy %q: %w", p.spec.Name, ErrLimited)
+		}
+	}
+	return nil
+}
+
+// Close stops the internal timers of every policy.
+func (ps *Policies) Close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, p := range *ps.set.Swap(&[]*policy{}) {
+		p.close()
+	}
+}
+
+// Watch loads the policies from the file at "name", then polls it every
+// "interval" and reloads the policies whenever it changes. Errors from
+// subsequent reloads are passed to "onError", if not nil, and the current
+// policies are kept.
+//
+// The returned PolicyWatcher must be closed to stop polling.
+func (ps *Policies) Watch(name string, interval time.Duration, onError func(error)) (*PolicyWatcher, error) {
+	w := &PolicyWatcher{
+		ps:      ps,
+		name:    name,
+		onError: onError,
+		ticker:  time.NewTicker(interval),
+		cch:     make(chan struct{}, 1),
+	}
+	if err := w.reload(); err != nil {
+		w.ticker.Stop()
+		return nil, err
+	}
+	go w.tick()
+	return w, nil
+}
+
+// PolicyWatcher reloads Policies when their config file changes.
+type PolicyWatcher struct {
+	// ps is the policies to reload
+	ps *Policies
+	// name is the path of the config file
+	name string
+	// onError is called with errors from reloads
+	onError func(error)
+	// modTime is the modification time of the file when last loaded
+	modTime time.Time
+	// size is the size of the file when last loaded
+	size int64
+	// ticker is the timer that polls the file
+	ticker *time.Ticker
+	// cch is the channel that listens for a close event
+	cch chan struct{}
+	// closed indicates whether the watcher is closed (1) or not (0)
+	closed uint32
+}
+
+func (w *PolicyWatcher) tick() {
+	for {
+		select {
+		case <-w.ticker.C:
+			if err := w.reload(); err != nil && w.onError != nil {
+				w.onError(err)
+			}
+		case <-w.cch:
+			w.ticker.Stop()
+			return
+		}
+	}
+}
+
+// Close stops polling the config file. It does not close the policies.
+//
+// It returns true if the watcher has been closed, or false if it has already
+// been closed.
+func (w *PolicyWatcher) Close() bool {
+	if !atomic.CompareAndSwapUint32(&w.closed, 0, 1) {
+		return false
+	}
+	w.cch <- struct{}{}
+	return true
+}
+
+// reload loads the config file if it changed since it was last loaded.
+func (w *PolicyWatcher) reload() error {
+	fi, err := os.Stat(w.name)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return nil
+	}
+	f, err := os.Open(w.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := w.ps.Load(f); err != nil {
+		return err
+	}
+	w.modTime, w.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// newPolicy builds the limiter for a valid PolicySpec.
+func newPolicy(spec PolicySpec) *policy {
+	period, _ := time.ParseDuration(spec.Period)
+	if spec.Type == "bucket" {
+		burst := spec.Burst
+		if burst == 0 {
+			burst = spec.Limit
+		}
+		// refill one token every period/limit, so that the rate doesn't
+		// depend on the bucket size, in larger steps if that would make
+		// the ticker fire more than once per millisecond
+		step := int64(math.Ceil(float64(spec.Limit) * float64(time.Millisecond) / float64(period)))
+		step = min(max(step, 1), burst)
+		interval := max(time.Duration(float64(period)*float64(step)/float64(spec.Limit)), 1)
+		return &policy{spec: spec, tb: NewBurstyTBucket(burst, step, interval)}
+	}
+	return &policy{spec: spec, lim: NewLimiterOf[string](spec.Limit, period)}
+}
+
+// parsePolicies parses and validates a JSON policy config.
+func parsePolicies(data []byte) ([]PolicySpec, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	// syntax errors are reported where they occur, and any other error at
+	// the start of the object that caused it (the offset of a type error
+	// is relative to the value being decoded, not to the config)
+	fail := func(off int64, name string, err error) error {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			off = serr.Offset
+		}
+		return &PolicyError{Line: lineAt(data, off), Policy: name, Err: err}
+	}
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, fail(dec.InputOffset(), "", err)
+	}
+	var specs []PolicySpec
+	for dec.More() {
+		off := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fail(off, "", err)
+		}
+		if tok != "policies" {
+			return nil, fail(off, "", fmt.Errorf("unknown field %q", tok))
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, fail(dec.InputOffset(), "", err)
+		}
+		names := make(map[string]bool)
+		for dec.More() {
+			off := skipSeparators(data, dec.InputOffset())
+			var spec PolicySpec
+			if err := dec.Decode(&spec); err != nil {
+				return nil, fail(off, "", err)
+			}
+			if err := validatePolicy(spec, names); err != nil {
+				return nil, fail(off, spec.Name, err)
+			}
+			names[spec.Name] = true
+			specs = append(specs, spec)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, fail(dec.InputOffset(), "", err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, fail(dec.InputOffset(), "", err)
+	}
+	return specs, nil
+}
+
+// validatePolicy returns an error if "spec" is invalid, or if its name is
+// already in "names".
+func validatePolicy(spec PolicySpec, names map[string]bool) error {
+	if spec.Name == "" {
+		return errors.New("missing name")
+	}
+	if names[spec.Name] {
+		return errors.New("duplicate name")
+	}
+	switch spec.Type {
+	case "", "limiter":
+		if spec.Burst != 0 {
+			return errors.New("burst is only valid for bucket policies")
+		}
+	case "bucket":
+		if spec.Key != "" {
+			return errors.New("bucket policies cannot have a key")
+		}
+		if spec.Burst < 0 {
+			return fmt.Errorf("invalid burst %d", spec.Burst)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", spec.Type)
+	}
+	if spec.Limit < 1 {
+		return fmt.Errorf("invalid limit %d", spec.Limit)
+	}
+	period, err := time.ParseDuration(spec.Period)
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid period %q", spec.Period)
+	}
+	for attr, pattern := range spec.Match {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q for %q", pattern, attr)
+		}
+	}
+	return nil
+}
+
+// expectDelim reads the next token from "dec", returning an error if it isn't
+// the delimiter "d".
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return fmt.Errorf("expected %q, found %v", d, tok)
+	}
+	return nil
+}
+
+// skipSeparators returns the offset of the first byte at or after "off" that
+// is neither whitespace nor a comma.
+func skipSeparators(data []byte, off int64) int64 {
+	for off < int64(len(data)) {
+		switch data[off] {
+		case ' ', '\t', '\r', '\n', ',':
+			off++
+		default:
+			return off
+		}
+	}
+	return off
+}
+
+// lineAt returns the line number of the byte at offset "off" in "data".
+func lineAt(data []byte, off int64) int {
+	off = min(max(off, 0), int64(len(data)))
+	return bytes.Count(data[:off], []byte("\n")) + 1
+}
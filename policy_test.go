@@ -0,0 +1,197 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const samplePolicies = `{
+	"policies": [
+		{"name": "uploads", "match": {"route": "/api/upload"}, "key": "user", "limit": 2, "period": "1m"},
+		{"name": "gold", "match": {"tier": "gold"}, "type": "bucket", "limit": 3, "period": "1h"}
+	]
+}`
+
+func TestPoliciesAllow(t *testing.T) {
+	ps, err := LoadPolicies(strings.NewReader(samplePolicies))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer ps.Close()
+	upload := map[string]string{"route": "/api/upload", "user": "sample1"}
+	if ps.Allow(upload) != nil || ps.Allow(upload) != nil {
+		t.Error("Requests within the limit should be allowed")
+	}
+	err = ps.Allow(upload)
+	if !errors.Is(err, ErrLimited) || !strings.Contains(err.Error(), `"uploads"`) {
+		t.Error("Expected the uploads policy to deny:", err)
+	}
+	if ps.Allow(map[string]string{"route": "/api/upload", "user": "sample2"}) != nil {
+		t.Error("Other users should be allowed")
+	}
+	if ps.Allow(map[string]string{"route": "/api/other", "user": "sample1"}) != nil {
+		t.Error("Other routes should not match")
+	}
+	gold := map[string]string{"tier": "gold"}
+	if ps.AllowN(gold, 3) != nil || ps.Allow(gold) == nil {
+		t.Error("Bucket policy should allow its limit")
+	}
+}
+
+func TestPoliciesValidation(t *testing.T) {
+	tests := []struct {
+		config string
+		line   int
+		msg    string
+	}{
+		{"{\n\"policies\": [\n{\"name\": \"a\", \"limit\": 1, \"period\": \"1x\"}\n]}", 3, "invalid period"},
+		{"{\"policies\": [\n{\"name\": \"a\", \"limit\": 1, \"period\": \"1s\"},\n{\"name\": \"a\", \"limit\": 1, \"period\": \"1s\"}]}", 3, "duplicate name"},
+		{"{\"policies\": [\n\n{\"name\": \"a\", \"limit\": \"many\", \"period\": \"1s\"}]}", 3, "cannot unmarshal"},
+		{"{\"policies\": [\n{\"name\": \"a\", \"limit\": 1, \"period\": \"1s\", \"typo\": 1}]}", 2, "unknown field"},
+		{"{\"policies\": [\n{\"name\": \"a\", \"type\": \"bucket\", \"key\": \"user\", \"limit\": 1, \"period\": \"1s\"}]}", 2, "cannot have a key"},
+		{"{\n\"other\": []}", 2, "unknown field"},
+		{"{\"policies\": [\n{\"name\": \"a\",\n}]}", 3, "invalid character"},
+		{"{\"policies\": [\n{\"name\": \"a\", \"limit\": 1, \"period\": \"1s\"},\n\n{\"name\": \"b\",\n\"limit\": \"many\", \"period\": \"1s\"}]}", 4, "cannot unmarshal"},
+	}
+	for i, test := range tests {
+		_, err := LoadPolicies(strings.NewReader(test.config))
+		var perr *PolicyError
+		if !errors.As(err, &perr) {
+			t.Error("Expected PolicyError:", i, err)
+			continue
+		}
+		if perr.Line != test.line || !strings.Contains(err.Error(), test.msg) {
+			t.Error("Incorrect error:", i, perr.Line, err)
+		}
+	}
+}
+
+func TestPoliciesReload(t *testing.T) {
+	ps, err := LoadPolicies(strings.NewReader(samplePolicies))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer ps.Close()
+	upload := map[string]string{"route": "/api/upload", "user": "sample1"}
+	ps.AllowN(upload, 2)
+	// unchanged policies keep their state
+	if err := ps.Load(strings.NewReader(samplePolicies)); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ps.Allow(upload) == nil {
+		t.Error("Reload should keep the state of unchanged policies")
+	}
+	if err := ps.Load(strings.NewReader(`{"policies": [{"name": "a"}]}`)); err == nil {
+		t.Error("Expected error for invalid config")
+	}
+	if len(ps.Specs()) != 2 {
+		t.Error("Invalid config should keep the current policies")
+	}
+	changed := strings.Replace(samplePolicies, `"limit": 2`, `"limit": 5`, 1)
+	if err := ps.Load(strings.NewReader(changed)); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ps.Allow(upload) != nil {
+		t.Error("Changed policies should start with a fresh state")
+	}
+}
+
+func TestPoliciesWatch(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(name, []byte(samplePolicies), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ps := NewPolicies()
+	defer ps.Close()
+	w, err := ps.Watch(name, 10*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer w.Close()
+	if len(ps.Specs()) != 2 {
+		t.Error("Watch should load the file")
+	}
+	if err := os.WriteFile(name, []byte(`{"policies": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(ps.Specs()) != 0 {
+		t.Error("Watch should reload the file when it changes")
+	}
+	if !w.Close() || w.Close() {
+		t.Error("Close should only succeed once")
+	}
+}
+
+func TestPoliciesBucketRate(t *testing.T) {
+	ps, err := LoadPolicies(strings.NewReader(`{"policies": [
+		{"name": "fast", "type": "bucket", "limit": 100, "period": "100ms", "burst": 10}
+	]}`))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer ps.Close()
+	var oks int
+	start := time.Now()
+	for time.Since(start) < 300*time.Millisecond {
+		if ps.Allow(nil) == nil {
+			oks += 1
+		} else {
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	// 10 tokens in the bucket, plus about 300 added over 300ms
+	if oks < 200 || oks > 320 {
+		t.Error("Incorrect number of requests allowed:", oks)
+	}
+}
+
+func TestPoliciesRollback(t *testing.T) {
+	ps, err := LoadPolicies(strings.NewReader(`{"policies": [
+		{"name": "user", "key": "user", "limit": 5, "period": "1h"},
+		{"name": "global", "type": "bucket", "limit": 1, "period": "1h"}
+	]}`))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer ps.Close()
+	attrs := map[string]string{"user": "sample1"}
+	if ps.Allow(attrs) != nil {
+		t.Error("First request should be allowed")
+	}
+	for i := 0; i < 3; i++ {
+		if err := ps.Allow(attrs); err == nil || !strings.Contains(err.Error(), `"global"`) {
+			t.Error("Expected the global policy to deny:", err)
+		}
+	}
+	// the denied requests must not have been counted by the user policy
+	if !(*ps.set.Load())[0].lim.IncBy("sample1", 4) {
+		t.Error("Denied requests should be rolled back")
+	}
+}
@@ -23,74 +23,267 @@
 package ratelim
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-type Pool struct {
-	max   int64
+// PoolHooks defines optional callbacks that manage the lifecycle of items in a
+// PoolOf. Any nil callback is ignored.
+type PoolHooks[T any] struct {
+	// OnGet validates an idle item before it is returned by Get. If it
+	// returns false, the item is destroyed and another one is tried.
+	OnGet func(T) bool
+	// OnPut resets an item before it is returned to the pool.
+	OnPut func(T)
+	// Close destroys an item that is discarded by the pool, because the
+	// pool is full, the item failed validation, or it was idle too long.
+	Close func(T)
+	// MaxIdle is the maximum duration an item may sit idle in the pool
+	// before it is destroyed. A value of 0 means no maximum.
+	MaxIdle time.Duration
+}
+
+// poolItem is a single idle item in a PoolOf.
+type poolItem[T any] struct {
+	// value is the pooled item
+	value T
+	// idle is the time the item was returned to the pool
+	idle time.Time
+}
+
+// PoolOf is a pool of reusable items of type T.
+type PoolOf[T any] struct {
+	// max is the maximum number of idle items in the pool
+	max int64
+	// mu is the mutex for accessing psize and list, so that the size and
+	// contents of the pool are always updated together
+	mu sync.Mutex
+	// psize is the number of idle items in the pool
 	psize int64
-	new   func() interface{}
-	list  *List
+	// new creates an item when the pool is empty
+	new func() T
+	// list holds the idle items, oldest first
+	list *ListOf[poolItem[T]]
+	// hooks are the lifecycle callbacks for items
+	hooks PoolHooks[T]
+	// ticker is the timer that reaps idle items, if MaxIdle is set
+	ticker *time.Ticker
+	// cch is the channel that listens for a close event
+	cch chan struct{}
+	// closed indicates whether the pool is closed (1) or not (0)
+	closed uint32
 }
 
+// Pool is a PoolOf holding items of any type. It is kept for compatibility
+// with code written before PoolOf was introduced.
+type Pool = PoolOf[interface{}]
+
 func NewPool(max int64, new func() interface{}) *Pool {
+	return NewPoolOf(max, new)
+}
+
+// NewPoolOf returns an initialized PoolOf pointer that holds at most "max"
+// idle items, and uses "new" to create items when the pool is empty.
+func NewPoolOf[T any](max int64, new func() T) *PoolOf[T] {
+	return NewHookedPoolOf(max, new, PoolHooks[T]{})
+}
+
+// NewHookedPoolOf returns an initialized PoolOf pointer that holds at most
+// "max" idle items, uses "new" to create items when the pool is empty, and
+// calls the provided hooks to manage the lifecycle of items.
+//
+// If hooks.MaxIdle is set, a timer periodically destroys items that have been
+// idle for too long, and Close must be called to stop it once the pool will
+// no longer be used.
+func NewHookedPoolOf[T any](max int64, new func() T, hooks PoolHooks[T]) *PoolOf[T] {
 	if max < 1 {
 		max = 1
 	}
-	return &Pool{
-		max:  max,
-		new:  new,
-		list: NewList(),
+	p := &PoolOf[T]{
+		max:   max,
+		new:   new,
+		list:  NewListOf[poolItem[T]](),
+		hooks: hooks,
+		cch:   make(chan struct{}, 1),
 	}
+	if hooks.MaxIdle > 0 {
+		p.ticker = time.NewTicker(hooks.MaxIdle / 2)
+		go p.tick()
+	}
+	return p
 }
 
-func (p *Pool) Empty() {
+// tick reaps idle items each time the ticker goes off, until the pool is
+// closed.
+func (p *PoolOf[T]) tick() {
 	for {
-		var done bool
-		for !done {
-			if c := atomic.LoadInt64(&p.psize); c > 0 {
-				done = atomic.CompareAndSwapInt64(&p.psize, c, c-1)
-			} else {
-				// pool is now empty
-				return
-			}
+		select {
+		case <-p.cch:
+			p.ticker.Stop()
+			return
+		case <-p.ticker.C:
+			p.reap()
 		}
-		p.list.LPop()
 	}
 }
 
-func (p *Pool) Get() interface{} {
-	// attempt to retrieve existing item from pool
-	var done bool
-	for !done {
-		if c := atomic.LoadInt64(&p.psize); c > 0 {
-			done = atomic.CompareAndSwapInt64(&p.psize, c, c-1)
-		} else {
-			// no items in pool, create a new item
-			return p.new()
-		}
+// Close destroys all idle items and stops the timer that reaps idle items.
+// Items returned to a closed pool with Put are destroyed immediately.
+//
+// It returns true if the pool has been closed, or false if the pool has
+// already been closed.
+func (p *PoolOf[T]) Close() bool {
+	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
+		return false
 	}
-	// return item from pool
-	return p.list.LPop()
+	if p.ticker != nil {
+		p.cch <- struct{}{}
+	}
+	p.Empty()
+	return true
+}
+
+// IsClosed returns true if the pool has been closed. It returns false if it is
+// still open.
+func (p *PoolOf[T]) IsClosed() bool {
+	return atomic.LoadUint32(&p.closed) != 0
+}
+
+// Len returns the number of idle items in the pool.
+func (p *PoolOf[T]) Len() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.psize
 }
 
-func (p *Pool) Put(item interface{}) {
-	// attempt to return item to the pool
-	var done bool
-	for !done {
-		if c := atomic.LoadInt64(&p.psize); c < p.max {
-			done = atomic.CompareAndSwapInt64(&p.psize, c, c+1)
-		} else {
-			// pool is full, discard item
+func (p *PoolOf[T]) Empty() {
+	for {
+		item, ok := p.pop()
+		if !ok {
+			// pool is now empty
 			return
 		}
+		p.destroy(item.value)
+	}
+}
+
+func (p *PoolOf[T]) Get() T {
+	// attempt to retrieve existing item from pool
+	if v, ok := p.get(); ok {
+		return v
+	}
+	// no items in pool, create a new item
+	return p.new()
+}
+
+func (p *PoolOf[T]) Put(item T) {
+	if p.hooks.OnPut != nil {
+		p.hooks.OnPut(item)
+	}
+	pi := poolItem[T]{value: item}
+	if p.hooks.MaxIdle > 0 {
+		pi.idle = time.Now()
+	}
+	if !p.push(pi, false) {
+		// pool is full or closed, discard item
+		p.destroy(item)
 	}
-	// add item to pool
-	p.list.RPush(item)
 }
 
-func (p *Pool) Use(f func(interface{})) {
+func (p *PoolOf[T]) Use(f func(T)) {
 	v := p.Get()
 	f(v)
 	p.Put(v)
 }
+
+// get returns a valid idle item from the pool, destroying any expired or
+// invalid items along the way. It returns false if the pool is empty.
+func (p *PoolOf[T]) get() (T, bool) {
+	for {
+		item, ok := p.pop()
+		if !ok {
+			return item.value, false
+		}
+		if p.expired(item, time.Time{}) {
+			p.destroy(item.value)
+			continue
+		}
+		if p.hooks.OnGet != nil && !p.hooks.OnGet(item.value) {
+			p.destroy(item.value)
+			continue
+		}
+		return item.value, true
+	}
+}
+
+// pop removes the oldest idle item from the pool, returning false if the pool
+// is empty.
+func (p *PoolOf[T]) pop() (poolItem[T], bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.psize == 0 {
+		return poolItem[T]{}, false
+	}
+	p.psize -= 1
+	return p.list.LPop(), true
+}
+
+// push adds an idle item to the pool, as the oldest item if "front" is true,
+// returning false if the pool is full or closed.
+//
+// The closed flag is checked with p.mu held, so that an item pushed
+// concurrently with Close is either rejected or removed by Close's Empty.
+func (p *PoolOf[T]) push(item poolItem[T], front bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.IsClosed() || p.psize >= p.max {
+		return false
+	}
+	p.psize += 1
+	if front {
+		p.list.LPush(item)
+	} else {
+		p.list.RPush(item)
+	}
+	return true
+}
+
+// reap destroys the idle items that have been in the pool for longer than
+// MaxIdle. Items are kept in the order they were returned, so reaping stops at
+// the first item that has not expired.
+func (p *PoolOf[T]) reap() {
+	now := time.Now()
+	for {
+		item, ok := p.pop()
+		if !ok {
+			return
+		}
+		if !p.expired(item, now) {
+			if !p.push(item, true) {
+				p.destroy(item.value)
+			}
+			return
+		}
+		p.destroy(item.value)
+	}
+}
+
+// expired returns true if the item has been idle for longer than MaxIdle. If
+// "now" is the zero time, the current time is used.
+func (p *PoolOf[T]) expired(item poolItem[T], now time.Time) bool {
+	if p.hooks.MaxIdle <= 0 || item.idle.IsZero() {
+		return false
+	}
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return now.Sub(item.idle) > p.hooks.MaxIdle
+}
+
+// destroy calls the Close hook for an item that is discarded by the pool.
+func (p *PoolOf[T]) destroy(item T) {
+	if p.hooks.Close != nil {
+		p.hooks.Close(item)
+	}
+}
@@ -24,8 +24,10 @@ package ratelim
 
 import (
 	"bytes"
+	"sync"
+	"sync/atomic"
 	"testing"
-	//"time"
+	"time"
 )
 
 func TestPoolGet(t *testing.T) {
@@ -44,6 +46,103 @@ func TestPoolGet(t *testing.T) {
 	}
 }
 
+func TestPoolOfUse(t *testing.T) {
+	var created int
+	p := NewPoolOf(1, func() *bytes.Buffer {
+		created += 1
+		return new(bytes.Buffer)
+	})
+	for i := 0; i < 3; i++ {
+		p.Use(func(buf *bytes.Buffer) {
+			buf.Reset()
+			buf.WriteString("sample")
+		})
+	}
+	if created != 1 {
+		t.Error("Pool should reuse items:", created)
+	}
+}
+
+func TestPoolHooks(t *testing.T) {
+	var resets, closes int
+	p := NewHookedPoolOf(1, func() *bytes.Buffer {
+		return new(bytes.Buffer)
+	}, PoolHooks[*bytes.Buffer]{
+		OnGet: func(buf *bytes.Buffer) bool { return buf.Len() == 0 },
+		OnPut: func(buf *bytes.Buffer) { resets += 1 },
+		Close: func(buf *bytes.Buffer) { closes += 1 },
+	})
+	b1, b2 := p.Get(), p.Get()
+	p.Put(b1)
+	p.Put(b2)
+	if resets != 2 || closes != 1 {
+		t.Error("Put should reset items and close them when full:", resets, closes)
+	}
+	// OnPut doesn't actually reset, so validation fails in Get
+	b1.WriteString("broken")
+	if p.Get() == b1 || closes != 2 {
+		t.Error("Get should discard items that fail validation")
+	}
+	p.Close()
+	p.Put(b2)
+	if closes != 3 {
+		t.Error("Put on a closed pool should close the item")
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	var closes int32
+	p := NewHookedPoolOf(5, func() *bytes.Buffer {
+		return new(bytes.Buffer)
+	}, PoolHooks[*bytes.Buffer]{
+		Close:   func(buf *bytes.Buffer) { atomic.AddInt32(&closes, 1) },
+		MaxIdle: time.Millisecond * 20,
+	})
+	defer p.Close()
+	p.Put(new(bytes.Buffer))
+	p.Put(new(bytes.Buffer))
+	time.Sleep(time.Millisecond * 60)
+	if p.Len() != 0 || atomic.LoadInt32(&closes) != 2 {
+		t.Error("Idle items should be reaped:", closes)
+	}
+}
+
+func TestPoolGetStress(t *testing.T) {
+	p := NewPoolOf(4, func() *bytes.Buffer {
+		return new(bytes.Buffer)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				buf := p.Get()
+				if buf == nil {
+					t.Error("Get returned a nil item")
+					return
+				}
+				p.Put(buf)
+				if j%100 == 0 {
+					p.Empty()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := p.Len(); n < 0 || n > 4 {
+		t.Error("Incorrect pool size:", n)
+	}
+	var items int64
+	p.list.LEach(func(int, poolItem[*bytes.Buffer]) bool {
+		items += 1
+		return true
+	})
+	if items != p.Len() {
+		t.Error("Pool size does not match its contents:", items, p.Len())
+	}
+}
+
 /*
 func TestPoolGetAndWait(t *testing.T) {
 	p := NewPool(5, func() interface{} {
@@ -73,3 +172,25 @@ func TestPoolGetAndWait(t *testing.T) {
 	}
 }
 */
+
+func TestPoolPutClose(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var closes int32
+		p := NewHookedPoolOf(10, func() int { return 0 }, PoolHooks[int]{
+			Close: func(int) { atomic.AddInt32(&closes, 1) },
+		})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.Put(j)
+			}()
+		}
+		p.Close()
+		wg.Wait()
+		if p.Len() != 0 || atomic.LoadInt32(&closes) != 4 {
+			t.Fatal("Items put during Close should be destroyed:", p.Len(), closes)
+		}
+	}
+}
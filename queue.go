@@ -0,0 +1,146 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"sync/atomic"
+)
+
+// qcell is a single slot in a Queue.
+type qcell[T any] struct {
+	// seq is the sequence number that tells producers and consumers whether
+	// the slot is ready for them
+	seq uint64
+	// value is the value stored in the slot
+	value T
+}
+
+// Queue is a bounded, lock-free, multi-producer multi-consumer FIFO queue
+// holding values of type T. Values are pushed with LPush and popped with RPop,
+// matching the FIFO use of a List.
+//
+// Unlike a List, a Queue never blocks or takes a lock, but its capacity is
+// fixed and its slots are allocated up front.
+//
+// It is an implementation of Dmitry Vyukov's bounded MPMC queue, see:
+// https://www.1024cores.net/home/lock-free-algorithms/queues/bounded-mpmc-queue
+type Queue[T any] struct {
+	// cells holds the slots of the ring buffer
+	cells []qcell[T]
+	// size is the number of slots
+	size uint64
+	// pad0 prevents false sharing between the fields above and below
+	pad0 [64]byte
+	// head is the position of the next value to pop
+	head uint64
+	// pad1 prevents false sharing between head and tail
+	pad1 [64]byte
+	// tail is the position of the next value to push
+	tail uint64
+	// pad2 prevents false sharing with neighbouring data
+	pad2 [64]byte
+}
+
+// NewQueue returns an initialized Queue pointer that holds at most "size"
+// values. If "size" is smaller than 1, the value 1 will be used.
+func NewQueue[T any](size int) *Queue[T] {
+	if size < 1 {
+		size = 1
+	}
+	q := &Queue[T]{
+		cells: make([]qcell[T], size),
+		size:  uint64(size),
+	}
+	for i := range q.cells {
+		q.cells[i].seq = uint64(i)
+	}
+	return q
+}
+
+// LPush adds the provided value to the queue.
+//
+// It returns true if the value has been added, or false if the queue is full.
+func (q *Queue[T]) LPush(v T) bool {
+	for {
+		pos := atomic.LoadUint64(&q.tail)
+		c := &q.cells[pos%q.size]
+		seq := atomic.LoadUint64(&c.seq)
+		switch dif := int64(seq - pos); {
+		case dif == 0:
+			// the slot is free, attempt to claim it
+			if atomic.CompareAndSwapUint64(&q.tail, pos, pos+1) {
+				c.value = v
+				atomic.StoreUint64(&c.seq, pos+1)
+				return true
+			}
+		case dif < 0:
+			// the slot hasn't been consumed yet, queue is full
+			return false
+		}
+		// another producer claimed the slot, try again
+	}
+}
+
+// RPop removes the oldest value from the queue.
+//
+// It returns the value and true, or the zero value of T and false if the queue
+// is empty.
+func (q *Queue[T]) RPop() (T, bool) {
+	for {
+		pos := atomic.LoadUint64(&q.head)
+		c := &q.cells[pos%q.size]
+		seq := atomic.LoadUint64(&c.seq)
+		switch dif := int64(seq - (pos + 1)); {
+		case dif == 0:
+			// the slot is filled, attempt to claim it
+			if atomic.CompareAndSwapUint64(&q.head, pos, pos+1) {
+				v := c.value
+				var zero T
+				c.value = zero
+				atomic.StoreUint64(&c.seq, pos+q.size)
+				return v, true
+			}
+		case dif < 0:
+			// the slot hasn't been filled yet, queue is empty
+			var zero T
+			return zero, false
+		}
+		// another consumer claimed the slot, try again
+	}
+}
+
+// Len returns the number of values in the queue. When the queue is used
+// concurrently, the result is only an approximation.
+func (q *Queue[T]) Len() int {
+	head := atomic.LoadUint64(&q.head)
+	tail := atomic.LoadUint64(&q.tail)
+	if tail < head {
+		return 0
+	}
+	return int(tail - head)
+}
+
+// Cap returns the maximum number of values the queue can hold.
+func (q *Queue[T]) Cap() int {
+	return int(q.size)
+}
@@ -0,0 +1,108 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue[int](3)
+	for i := 0; i < 3; i++ {
+		if !q.LPush(i) {
+			t.Error("LPush failed on a non-full queue")
+		}
+	}
+	if q.LPush(3) {
+		t.Error("LPush succeeded on a full queue")
+	}
+	if q.Len() != 3 || q.Cap() != 3 {
+		t.Error("Incorrect queue length or capacity")
+	}
+	for i := 0; i < 3; i++ {
+		if v, ok := q.RPop(); !ok || v != i {
+			t.Error("RPop returned an incorrect value:", v, ok)
+		}
+	}
+	if _, ok := q.RPop(); ok {
+		t.Error("RPop succeeded on an empty queue")
+	}
+}
+
+func TestQueueStress(t *testing.T) {
+	q := NewQueue[int64](64)
+	const producers, perProducer = 4, 2000
+	var sum, popped int64
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := int64(1); i <= perProducer; {
+				if q.LPush(i) {
+					i++
+				} else {
+					runtime.Gosched()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt64(&popped) < producers*perProducer {
+				if v, ok := q.RPop(); ok {
+					atomic.AddInt64(&sum, v)
+					atomic.AddInt64(&popped, 1)
+				} else {
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if want := int64(producers * perProducer * (perProducer + 1) / 2); sum != want {
+		t.Error("Values lost or duplicated:", sum, want)
+	}
+}
+
+func BenchmarkQueueParallel(b *testing.B) {
+	q := NewQueue[int](1024)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			q.LPush(1)
+			q.RPop()
+		}
+	})
+}
+
+func BenchmarkListParallel(b *testing.B) {
+	l := NewListOf[int]()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.LPush(1)
+			l.RPop()
+		}
+	})
+}
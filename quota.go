@@ -0,0 +1,341 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Period is the length of a calendar-aligned quota period.
+type Period int
+
+const (
+	// Hourly periods start at the beginning of each hour.
+	Hourly Period = iota
+	// Daily periods start at midnight.
+	Daily
+	// Weekly periods start at midnight on Monday.
+	Weekly
+	// Monthly periods start at midnight on the first day of the month.
+	Monthly
+)
+
+// String returns the name of the period.
+func (p Period) String() string {
+	switch p {
+	case Hourly:
+		return "hourly"
+	case Daily:
+		return "daily"
+	case Weekly:
+		return "weekly"
+	case Monthly:
+		return "monthly"
+	}
+	return "unknown"
+}
+
+// Start returns the start of the period containing "t", in the time zone
+// "loc". Unknown periods are treated as Daily.
+func (p Period) Start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch p {
+	case Hourly:
+		// derive the hour from the instant, since the local hour is
+		// ambiguous when clocks are turned back
+		return t.Add(-time.Duration(t.Minute())*time.Minute -
+			time.Duration(t.Second())*time.Second -
+			time.Duration(t.Nanosecond()))
+	case Weekly:
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case Monthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// Next returns the start of the period following the one starting at "start".
+func (p Period) Next(start time.Time) time.Time {
+	y, m, d := start.Date()
+	switch p {
+	case Hourly:
+		return start.Add(time.Hour)
+	case Weekly:
+		return time.Date(y, m, d+7, 0, 0, 0, 0, start.Location())
+	case Monthly:
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, start.Location())
+	}
+	return time.Date(y, m, d+1, 0, 0, 0, 0, start.Location())
+}
+
+// QuotaStore stores the usage of each key of a Quota. It must be safe for
+// concurrent use.
+//
+// Usage is recorded per period, identified by its start time. A store only
+// needs to keep the most recent period for each key.
+type QuotaStore interface {
+	// Get returns the usage of "key" in the period starting at "start".
+	Get(key string, start time.Time) (int64, error)
+	// IncBy atomically adds "n" to the usage of "key" in the period
+	// starting at "start", unless the result would exceed "limit". It
+	// returns the resulting usage, and whether "n" was added.
+	IncBy(key string, start time.Time, n, limit int64) (int64, bool, error)
+}
+
+// quotaRecord is the usage of a single key in a MemoryQuotaStore.
+type quotaRecord struct {
+	// Start is the start of the period
+	Start time.Time `json:"start"`
+	// Used is the usage in the period
+	Used int64 `json:"used"`
+}
+
+// MemoryQuotaStore is a QuotaStore that keeps usage in memory. Its state can
+// be persisted with Save and restored with Load, e.g. across restarts.
+type MemoryQuotaStore struct {
+	// mu is the mutex for accessing records
+	mu sync.Mutex
+	// records holds the usage of each key
+	records map[string]quotaRecord
+}
+
+// NewMemoryQuotaStore returns an initialized, empty MemoryQuotaStore pointer.
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{records: make(map[string]quotaRecord)}
+}
+
+// Get returns the usage of "key" in the period starting at "start".
+func (ms *MemoryQuotaStore) Get(key string, start time.Time) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if r, ok := ms.records[key]; ok && r.Start.Equal(start) {
+		return r.Used, nil
+	}
+	return 0, nil
+}
+
+// IncBy adds "n" to the usage of "key" in the period starting at "start",
+// unless the result would exceed "limit". Usage from earlier periods is
+// discarded.
+func (ms *MemoryQuotaStore) IncBy(key string, start time.Time, n, limit int64) (int64, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	r := ms.records[key]
+	if !r.Start.Equal(start) {
+		if r.Start.After(start) {
+			// a later period has already started, don't go back
+			return r.Used, false, nil
+		}
+		r = quotaRecord{Start: start}
+	}
+	if r.Used+n > limit {
+		return r.Used, false, nil
+	}
+	r.Used += n
+	ms.records[key] = r
+	return r.Used, true, nil
+}
+
+// Save writes the usage of every key to "w" as JSON.
+func (ms *MemoryQuotaStore) Save(w io.Writer) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return json.NewEncoder(w).Encode(ms.records)
+}
+
+// Load replaces the usage of every key with the JSON read from "r", as written
+// by Save.
+func (ms *MemoryQuotaStore) Load(r io.Reader) error {
+	records := make(map[string]quotaRecord)
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	ms.records = records
+	ms.mu.Unlock()
+	return nil
+}
+
+// QuotaUsage is the usage of a single key in its current quota period.
+type QuotaUsage struct {
+	// Key is the key
+	Key string
+	// Used is the usage in the current period
+	Used int64
+	// Limit is the key's limit per period
+	Limit int64
+	// Start is the start of the current period
+	Start time.Time
+	// Reset is the start of the next period, when usage is reset
+	Reset time.Time
+}
+
+// Remaining returns the usage left in the current period.
+func (u QuotaUsage) Remaining() int64 {
+	return max(u.Limit-u.Used, 0)
+}
+
+// Quota limits the usage per key over long, calendar-aligned periods (e.g.
+// 10000 requests per day, resetting at midnight in a given time zone).
+//
+// Unlike LimiterOf, whose windows are relative to process start and whose
+// counts are lost on restart, usage is kept in a pluggable QuotaStore and
+// periods are aligned to the calendar.
+type Quota struct {
+	// period is the length of each period
+	period Period
+	// loc is the time zone the periods are aligned to
+	loc *time.Location
+	// store holds the usage of each key
+	store QuotaStore
+	// mu is the mutex for accessing limit, limits, thresholds and onThreshold
+	mu sync.RWMutex
+	// limit is the default limit per period
+	limit int64
+	// limits holds the limits of keys that don't use the default
+	limits map[string]int64
+	// thresholds are the fractions of the limit that trigger onThreshold
+	thresholds []float64
+	// onThreshold is called when usage crosses one of the thresholds
+	onThreshold func(u QuotaUsage, threshold float64)
+}
+
+// NewQuota returns an initialized Quota pointer that allows "limit" usage per
+// key in each period, aligned to the time zone "loc" and stored in "store". If
+// "loc" is nil, UTC is used. If "store" is nil, a new MemoryQuotaStore is used.
+func NewQuota(period Period, loc *time.Location, limit int64, store QuotaStore) *Quota {
+	if loc == nil {
+		loc = time.UTC
+	}
+	if store == nil {
+		store = NewMemoryQuotaStore()
+	}
+	return &Quota{
+		period: period,
+		loc:    loc,
+		store:  store,
+		limit:  limit,
+		limits: make(map[string]int64),
+	}
+}
+
+// SetLimit sets the limit per period for "key", overriding the default.
+func (q *Quota) SetLimit(key string, limit int64) {
+	q.mu.Lock()
+	q.limits[key] = limit
+	q.mu.Unlock()
+}
+
+// ResetLimit makes "key" use the default limit again.
+func (q *Quota) ResetLimit(key string) {
+	q.mu.Lock()
+	delete(q.limits, key)
+	q.mu.Unlock()
+}
+
+// Limit returns the limit per period for "key".
+func (q *Quota) Limit(key string) int64 {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if limit, ok := q.limits[key]; ok {
+		return limit
+	}
+	return q.limit
+}
+
+// OnThreshold registers a function that is called when the usage of a key
+// crosses one of the provided fractions of its limit (e.g. 0.8 for a soft limit
+// warning at 80%). It is called at most once per threshold, key and period,
+// by the goroutine whose usage crossed it.
+func (q *Quota) OnThreshold(f func(u QuotaUsage, threshold float64), thresholds ...float64) {
+	q.mu.Lock()
+	q.onThreshold = f
+	q.thresholds = thresholds
+	q.mu.Unlock()
+}
+
+// Allow records a single use for "key". See AllowN for more information.
+func (q *Quota) Allow(key string) (bool, error) {
+	return q.AllowN(key, 1)
+}
+
+// AllowN records "n" uses for "key", returning true if they fit within the
+// key's limit in the current period. Otherwise, false is returned and nothing
+// is recorded. If "n" is larger than the key's limit, ErrTooLarge is returned,
+// since the uses can never fit. Otherwise, an error is only returned if the
+// store fails.
+func (q *Quota) AllowN(key string, n int64) (bool, error) {
+	if n < 1 {
+		return true, nil
+	}
+	limit := q.Limit(key)
+	if n > limit {
+		return false, ErrTooLarge
+	}
+	start := q.period.Start(time.Now(), q.loc)
+	used, ok, err := q.store.IncBy(key, start, n, limit)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	q.mu.RLock()
+	f, thresholds := q.onThreshold, q.thresholds
+	q.mu.RUnlock()
+	if f == nil {
+		return true, nil
+	}
+	u := QuotaUsage{
+		Key:   key,
+		Used:  used,
+		Limit: limit,
+		Start: start,
+		Reset: q.period.Next(start),
+	}
+	for _, t := range thresholds {
+		mark := t * float64(limit)
+		if float64(used-n) < mark && float64(used) >= mark {
+			f(u, t)
+		}
+	}
+	return true, nil
+}
+
+// Usage returns the usage of "key" in the current period.
+func (q *Quota) Usage(key string) (QuotaUsage, error) {
+	start := q.period.Start(time.Now(), q.loc)
+	used, err := q.store.Get(key, start)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	return QuotaUsage{
+		Key:   key,
+		Used:  used,
+		Limit: q.Limit(key),
+		Start: start,
+		Reset: q.period.Next(start),
+	}, nil
+}
@@ -0,0 +1,131 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	// 2024-03-06 02:30 UTC is 2024-03-05 21:30 in UTC-5, a Tuesday
+	now := time.Date(2024, 3, 6, 2, 30, 0, 0, time.UTC)
+	tests := []struct {
+		period Period
+		start  time.Time
+		next   time.Time
+	}{
+		{Hourly, time.Date(2024, 3, 5, 21, 0, 0, 0, loc), time.Date(2024, 3, 5, 22, 0, 0, 0, loc)},
+		{Daily, time.Date(2024, 3, 5, 0, 0, 0, 0, loc), time.Date(2024, 3, 6, 0, 0, 0, 0, loc)},
+		{Weekly, time.Date(2024, 3, 4, 0, 0, 0, 0, loc), time.Date(2024, 3, 11, 0, 0, 0, 0, loc)},
+		{Monthly, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 4, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, test := range tests {
+		start := test.period.Start(now, loc)
+		if !start.Equal(test.start) {
+			t.Error("Incorrect start:", test.period, start)
+		}
+		if next := test.period.Next(start); !next.Equal(test.next) {
+			t.Error("Incorrect next:", test.period, next)
+		}
+	}
+
+	// 2026-11-01 01:30 EST comes after the clocks are turned back from
+	// 02:00 EDT, so the hour starts at 01:00 EST rather than 01:00 EDT
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("Time zone database unavailable:", err)
+	}
+	now = time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC)
+	start := Hourly.Start(now, ny)
+	if want := time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Error("Incorrect start across DST:", start)
+	}
+	if next := Hourly.Next(start); !next.Equal(time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC)) {
+		t.Error("Incorrect next across DST:", next)
+	}
+}
+
+func TestQuotaAllow(t *testing.T) {
+	q := NewQuota(Daily, nil, 10, nil)
+	q.SetLimit("sample2", 2)
+	var oks int
+	for i := 0; i < 15; i++ {
+		if ok, err := q.Allow("sample1"); err != nil {
+			t.Fatal("Unexpected error:", err)
+		} else if ok {
+			oks += 1
+		}
+	}
+	if oks != 10 {
+		t.Error("Incorrect number of allowed uses:", oks)
+	}
+	if ok, err := q.AllowN("sample2", 3); ok || err != ErrTooLarge {
+		t.Error("Per-key limit should apply:", err)
+	}
+	q.AllowN("sample2", 2)
+	u, err := q.Usage("sample2")
+	if err != nil || u.Used != 2 || u.Limit != 2 || u.Remaining() != 0 {
+		t.Error("Incorrect usage:", u, err)
+	}
+	if !u.Reset.Equal(u.Start.AddDate(0, 0, 1)) {
+		t.Error("Incorrect reset time:", u.Reset)
+	}
+}
+
+func TestQuotaThresholds(t *testing.T) {
+	q := NewQuota(Monthly, time.UTC, 10, nil)
+	var crossed []float64
+	q.OnThreshold(func(u QuotaUsage, threshold float64) {
+		crossed = append(crossed, threshold)
+	}, 0.5, 0.8)
+	q.AllowN("sample1", 4)
+	q.AllowN("sample1", 4)
+	q.AllowN("sample1", 1)
+	if len(crossed) != 2 || crossed[0] != 0.5 || crossed[1] != 0.8 {
+		t.Error("Incorrect thresholds crossed:", crossed)
+	}
+}
+
+func TestMemoryQuotaStoreSaveLoad(t *testing.T) {
+	ms := NewMemoryQuotaStore()
+	q := NewQuota(Daily, time.UTC, 10, ms)
+	q.AllowN("sample1", 7)
+	var buf bytes.Buffer
+	if err := ms.Save(&buf); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	restored := NewMemoryQuotaStore()
+	if err := restored.Load(&buf); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	q = NewQuota(Daily, time.UTC, 10, restored)
+	if u, _ := q.Usage("sample1"); u.Used != 7 {
+		t.Error("Usage should survive a restart:", u.Used)
+	}
+	if ok, _ := q.AllowN("sample1", 4); ok {
+		t.Error("Restored usage should count towards the limit")
+	}
+}
@@ -0,0 +1,200 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Jitter is the strategy used to randomize backoff durations between retries.
+//
+// To learn more about backoff jitter, visit:
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type Jitter int
+
+const (
+	// NoJitter uses the exponential backoff duration as is.
+	NoJitter Jitter = iota
+	// FullJitter uses a random duration between 0 and the exponential
+	// backoff duration.
+	FullJitter
+	// DecorrelatedJitter uses a random duration between the base duration
+	// and three times the previous duration.
+	DecorrelatedJitter
+)
+
+// RetryPolicy defines how an operation is retried by Retry.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	// A value smaller than 1 retries until the context is done.
+	MaxAttempts int
+	// Base is the backoff duration before the first retry.
+	Base time.Duration
+	// Max is the maximum backoff duration. A value of 0 means no maximum.
+	Max time.Duration
+	// Jitter is the strategy used to randomize backoff durations.
+	Jitter Jitter
+	// Budget is an optional token bucket that retries are drawn from. Each
+	// call to Retry adds a single token to the bucket, and each retry
+	// removes RetryCost tokens. If the bucket doesn't have enough tokens,
+	// the operation is not retried.
+	//
+	// For example, a Budget with a RetryCost of 10 allows retries to be at
+	// most 10% of calls, plus whatever the bucket's own ticker adds.
+	Budget *TBucket
+	// RetryCost is the number of tokens removed from Budget for each retry.
+	// If smaller than 1, the value 1 will be used.
+	RetryCost int64
+	// Retryable optionally classifies errors as retryable or not. If nil,
+	// all errors not wrapped with Permanent are retryable.
+	Retryable func(error) bool
+}
+
+// permanentError wraps an error that should not be retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps "err" so that Retry returns it immediately instead of
+// retrying. Retry returns the original, unwrapped error.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// retryAfterError wraps an error with a duration to wait before retrying.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string             { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error             { return e.err }
+func (e *retryAfterError) RetryAfter() time.Duration { return e.after }
+
+// RetryAfter wraps "err" with a duration to wait before the operation is
+// retried. When returned from an operation, Retry waits for "d" instead of its
+// computed backoff.
+//
+// Any error implementing a "RetryAfter() time.Duration" method is treated the
+// same way.
+func RetryAfter(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err: err, after: d}
+}
+
+// Retry calls "op" until it succeeds, returns a non-retryable error, the
+// maximum number of attempts has been made, the retry budget has been
+// exhausted, or the context is done.
+//
+// It returns nil if "op" succeeded, or otherwise the last error returned by
+// "op" (or ctx.Err() if the context was done before "op" was called).
+func Retry(ctx context.Context, op func(context.Context) error, policy RetryPolicy) error {
+	cost := policy.RetryCost
+	if cost < 1 {
+		cost = 1
+	}
+	if policy.Budget != nil {
+		policy.Budget.AddToks(1)
+	}
+	var prev time.Duration
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := op(ctx)
+		if err == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if policy.Retryable != nil && !policy.Retryable(err) {
+			return err
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return err
+		}
+		if policy.Budget != nil && !policy.Budget.GetToks(cost) {
+			return err
+		}
+		// compute the backoff, letting a RetryAfter error override it
+		var ra interface{ RetryAfter() time.Duration }
+		if errors.As(err, &ra) {
+			prev = ra.RetryAfter()
+		} else {
+			prev = policy.backoff(attempt, prev)
+		}
+		timer := time.NewTimer(prev)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the duration to wait before retry number "attempt", given
+// the previous backoff duration.
+func (p RetryPolicy) backoff(attempt int, prev time.Duration) time.Duration {
+	var d time.Duration
+	switch p.Jitter {
+	case DecorrelatedJitter:
+		if prev < p.Base {
+			prev = p.Base
+		}
+		d = p.Base + randDuration(prev*3-p.Base)
+	default:
+		d = p.Base
+		for i := 1; i < attempt && (p.Max == 0 || d < p.Max); i++ {
+			d *= 2
+		}
+	}
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	if p.Jitter == FullJitter {
+		d = randDuration(d)
+	}
+	return d
+}
+
+// randDuration returns a random duration in the range [0, d).
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
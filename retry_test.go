@@ -0,0 +1,112 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryAttempts(t *testing.T) {
+	var calls int
+	err := Retry(context.Background(), func(context.Context) error {
+		calls += 1
+		if calls < 3 {
+			return errSample
+		}
+		return nil
+	}, RetryPolicy{MaxAttempts: 5, Base: time.Millisecond, Jitter: FullJitter})
+	if err != nil || calls != 3 {
+		t.Error("Retry should succeed on the third attempt:", err, calls)
+	}
+	calls = 0
+	err = Retry(context.Background(), func(context.Context) error {
+		calls += 1
+		return errSample
+	}, RetryPolicy{MaxAttempts: 3, Base: time.Millisecond})
+	if err != errSample || calls != 3 {
+		t.Error("Retry should stop after MaxAttempts:", err, calls)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	var calls int
+	err := Retry(context.Background(), func(context.Context) error {
+		calls += 1
+		return Permanent(errSample)
+	}, RetryPolicy{MaxAttempts: 5, Base: time.Millisecond})
+	if err != errSample || calls != 1 {
+		t.Error("Retry should not retry permanent errors:", err, calls)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tb := NewTBucket(10, time.Hour)
+	tb.Empty()
+	policy := RetryPolicy{MaxAttempts: 5, Budget: tb, RetryCost: 2}
+	var calls int
+	op := func(context.Context) error {
+		calls += 1
+		return errSample
+	}
+	// the first call deposits a single token, not enough for a retry
+	Retry(context.Background(), op, policy)
+	if calls != 1 {
+		t.Error("Retry should not retry without budget:", calls)
+	}
+	// the second call deposits another, enough for a single retry
+	Retry(context.Background(), op, policy)
+	if calls != 3 {
+		t.Error("Retry should retry once with budget:", calls)
+	}
+	tb.Close()
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls int
+	start := time.Now()
+	Retry(context.Background(), func(context.Context) error {
+		calls += 1
+		return RetryAfter(errSample, time.Millisecond*50)
+	}, RetryPolicy{MaxAttempts: 2, Base: time.Hour})
+	if dur := time.Since(start); dur < time.Millisecond*50 || dur > time.Second {
+		t.Error("RetryAfter should override the backoff:", dur)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Base: time.Millisecond, Max: time.Millisecond * 5}
+	if d := p.backoff(3, 0); d != time.Millisecond*4 {
+		t.Error("Incorrect exponential backoff:", d)
+	}
+	if d := p.backoff(10, 0); d != time.Millisecond*5 {
+		t.Error("Backoff should not exceed Max:", d)
+	}
+	p.Jitter = DecorrelatedJitter
+	for i := 0; i < 10; i++ {
+		if d := p.backoff(2, time.Millisecond*2); d < p.Base || d > p.Max {
+			t.Error("Decorrelated backoff out of range:", d)
+		}
+	}
+}
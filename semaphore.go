@@ -0,0 +1,328 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrTooLarge is returned when a request asks for more than a limiter can ever
+// provide (e.g. more permits than the size of a Semaphore).
+var ErrTooLarge = errors.New("ratelim: request exceeds limiter capacity")
+
+// semWaiter represents a single goroutine waiting in a Semaphore queue.
+type semWaiter struct {
+	// n is the number of permits requested
+	n int64
+	// ready is closed once the permits have been granted
+	ready chan struct{}
+}
+
+// Semaphore is a weighted counting semaphore used to limit the amount of
+// concurrent (in-flight) work.
+//
+// Waiters are served in FIFO order: a large request at the front of the queue
+// will block smaller requests behind it until it can be satisfied. This
+// prevents large requests from being starved by a steady stream of small ones.
+type Semaphore struct {
+	// size is the maximum number of permits that may be held at once
+	size int64
+	// cur is the number of permits currently held
+	cur int64
+	// mu is the mutex for accessing any semaphore data
+	mu sync.Mutex
+	// waiters is the FIFO queue of goroutines waiting for permits
+	waiters ListOf[semWaiter]
+}
+
+// NewSemaphore returns an initialized Semaphore pointer with "n" permits
+// available. If "n" is smaller than 1, the value 1 will be used.
+func NewSemaphore(n int64) *Semaphore {
+	if n < 1 {
+		n = 1
+	}
+	return &Semaphore{
+		size: n,
+	}
+}
+
+// Acquire acquires "n" permits from the Semaphore, blocking until they are
+// available or the provided context is done.
+//
+// It returns nil on success. If the context is done first, ctx.Err() is
+// returned and no permits are held. If "n" is larger than the size of the
+// Semaphore, ErrTooLarge is returned immediately.
+func (s *Semaphore) Acquire(ctx context.Context, n int64) error {
+	if n < 1 {
+		return nil
+	}
+	if n > s.size {
+		return ErrTooLarge
+	}
+	s.mu.Lock()
+	// fast path, permits are available and nobody is waiting
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+	// join the back of the queue
+	w := semWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// permits were granted after the context was done, give them
+			// back so the caller doesn't leak them
+			s.cur -= n
+			s.notifyWaiters()
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			// removing the front waiter may unblock the ones behind it
+			if isFront && s.size > s.cur {
+				s.notifyWaiters()
+			}
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// TryAcquire attempts to acquire "n" permits from the Semaphore without
+// blocking.
+//
+// It returns true if the permits have been acquired, or false if they are not
+// currently available (or other goroutines are already waiting).
+func (s *Semaphore) TryAcquire(n int64) bool {
+	if n < 1 {
+		return true
+	}
+	s.mu.Lock()
+	ok := s.size-s.cur >= n && s.waiters.Len() == 0
+	if ok {
+		s.cur += n
+	}
+	s.mu.Unlock()
+	return ok
+}
+
+// Release returns "n" permits to the Semaphore, waking any waiters that can
+// now be satisfied.
+//
+// Releasing more permits than are currently held is a programming error and
+// will cause a panic.
+func (s *Semaphore) Release(n int64) {
+	if n < 1 {
+		return
+	}
+	s.mu.Lock()
+	s.cur -= n
+	if s.cur < 0 {
+		s.mu.Unlock()
+		panic("ratelim: semaphore released more permits than held")
+	}
+	s.notifyWaiters()
+	s.mu.Unlock()
+}
+
+// InUse returns the number of permits currently held.
+func (s *Semaphore) InUse() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// notifyWaiters grants permits to waiters at the front of the queue for as
+// long as they can be satisfied. The caller must hold s.mu.
+func (s *Semaphore) notifyWaiters() {
+	for {
+		next := s.waiters.Front()
+		if next == nil {
+			return
+		}
+		w := next.Value
+		if s.size-s.cur < w.n {
+			// not enough permits for the next waiter, keep FIFO order by
+			// not skipping ahead to smaller requests
+			return
+		}
+		s.cur += w.n
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
+}
+
+// keyedSem is a single entry in a KeyedSemaphoreOf.
+type keyedSem struct {
+	// sem is the semaphore for the key
+	sem *Semaphore
+	// refs is the number of permits held or requested for the key
+	refs int64
+}
+
+// KeyedSemaphoreOf is a set of Semaphores, one per key of type K, that all
+// share the same size. It can be used to limit the amount of concurrent work
+// per key (e.g. at most 5 concurrent uploads per user).
+//
+// Keys are created on first use and are removed automatically when no permits
+// are held or requested for them, so memory usage is proportional to the number
+// of keys with in-flight work.
+type KeyedSemaphoreOf[K comparable] struct {
+	// size is the number of permits for each key
+	size int64
+	// mu is the mutex for accessing the sems map
+	mu sync.Mutex
+	// sems holds the semaphore for each active key
+	sems map[K]*keyedSem
+}
+
+// KeyedSemaphore is a KeyedSemaphoreOf with string keys.
+type KeyedSemaphore = KeyedSemaphoreOf[string]
+
+// NewKeyedSemaphore returns an initialized KeyedSemaphore pointer with "n"
+// permits available for each key. If "n" is smaller than 1, the value 1 will be
+// used.
+func NewKeyedSemaphore(n int64) *KeyedSemaphore {
+	return NewKeyedSemaphoreOf[string](n)
+}
+
+// NewKeyedSemaphoreOf returns an initialized KeyedSemaphoreOf pointer with "n"
+// permits available for each key. If "n" is smaller than 1, the value 1 will be
+// used.
+func NewKeyedSemaphoreOf[K comparable](n int64) *KeyedSemaphoreOf[K] {
+	if n < 1 {
+		n = 1
+	}
+	return &KeyedSemaphoreOf[K]{
+		size: n,
+		sems: make(map[K]*keyedSem),
+	}
+}
+
+// Acquire acquires "n" permits for "key", blocking until they are available or
+// the provided context is done. See Semaphore.Acquire for more information.
+func (ks *KeyedSemaphoreOf[K]) Acquire(ctx context.Context, key K, n int64) error {
+	if n < 1 {
+		return nil
+	}
+	if n > ks.size {
+		return ErrTooLarge
+	}
+	ks.mu.Lock()
+	e := ks.entry(key)
+	e.refs += n
+	ks.mu.Unlock()
+	if err := e.sem.Acquire(ctx, n); err != nil {
+		ks.unref(key, e, n)
+		return err
+	}
+	return nil
+}
+
+// TryAcquire attempts to acquire "n" permits for "key" without blocking. It
+// returns true if the permits have been acquired, or false otherwise.
+func (ks *KeyedSemaphoreOf[K]) TryAcquire(key K, n int64) bool {
+	if n < 1 {
+		return true
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	e := ks.entry(key)
+	if !e.sem.TryAcquire(n) {
+		if e.refs == 0 {
+			delete(ks.sems, key)
+		}
+		return false
+	}
+	e.refs += n
+	return true
+}
+
+// Release returns "n" permits for "key". The key is removed once no permits
+// are held or requested for it.
+//
+// Releasing more permits than are currently held for the key is a programming
+// error and will cause a panic.
+func (ks *KeyedSemaphoreOf[K]) Release(key K, n int64) {
+	if n < 1 {
+		return
+	}
+	ks.mu.Lock()
+	e, ok := ks.sems[key]
+	ks.mu.Unlock()
+	if !ok {
+		panic("ratelim: semaphore released more permits than held")
+	}
+	e.sem.Release(n)
+	ks.unref(key, e, n)
+}
+
+// InUse returns the number of permits currently held for "key".
+func (ks *KeyedSemaphoreOf[K]) InUse(key K) int64 {
+	ks.mu.Lock()
+	e, ok := ks.sems[key]
+	ks.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return e.sem.InUse()
+}
+
+// Len returns the number of keys that currently hold or are waiting for
+// permits.
+func (ks *KeyedSemaphoreOf[K]) Len() int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return len(ks.sems)
+}
+
+// entry returns the entry for "key", creating it if necessary. The caller must
+// hold ks.mu.
+func (ks *KeyedSemaphoreOf[K]) entry(key K) *keyedSem {
+	e, ok := ks.sems[key]
+	if !ok {
+		e = &keyedSem{sem: NewSemaphore(ks.size)}
+		ks.sems[key] = e
+	}
+	return e
+}
+
+// unref drops "n" references from the entry, removing it from the map once it
+// is no longer referenced.
+func (ks *KeyedSemaphoreOf[K]) unref(key K, e *keyedSem, n int64) {
+	ks.mu.Lock()
+	e.refs -= n
+	if e.refs <= 0 && ks.sems[key] == e {
+		delete(ks.sems, key)
+	}
+	ks.mu.Unlock()
+}
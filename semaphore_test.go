@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSemaphoreTryAcquire(t *testing.T) {
+	s := NewSemaphore(5)
+	if !s.TryAcquire(3) {
+		t.Error("TryAcquire failed with enough permits available")
+	}
+	if s.TryAcquire(3) {
+		t.Error("TryAcquire succeeded without enough permits available")
+	}
+	if !s.TryAcquire(2) {
+		t.Error("TryAcquire failed with enough permits available")
+	}
+	s.Release(5)
+	if s.InUse() != 0 {
+		t.Error("Incorrect number of permits in use after Release")
+	}
+	if s.Acquire(context.Background(), 6) != ErrTooLarge {
+		t.Error("Acquire should return ErrTooLarge when n exceeds the size")
+	}
+}
+
+func TestSemaphoreAcquireFIFO(t *testing.T) {
+	s := NewSemaphore(2)
+	s.TryAcquire(2)
+	var mu sync.Mutex
+	var order []int64
+	var wg sync.WaitGroup
+	for _, n := range []int64{2, 1} {
+		wg.Add(1)
+		go func(n int64) {
+			defer wg.Done()
+			if err := s.Acquire(context.Background(), n); err != nil {
+				t.Error("Acquire returned an error:", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, n)
+			mu.Unlock()
+			s.Release(n)
+		}(n)
+		time.Sleep(time.Millisecond * 10)
+	}
+	// a single permit is available, but the waiter for 2 is first in line
+	s.Release(1)
+	time.Sleep(time.Millisecond * 10)
+	if s.TryAcquire(1) {
+		t.Error("TryAcquire should not skip ahead of waiters")
+	}
+	s.Release(1)
+	wg.Wait()
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Error("Waiters not served in FIFO order:", order)
+	}
+}
+
+func TestSemaphoreAcquireCancel(t *testing.T) {
+	s := NewSemaphore(1)
+	s.TryAcquire(1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := s.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("Acquire should return the context error:", err)
+	}
+	s.Release(1)
+	if s.InUse() != 0 {
+		t.Error("Cancelled Acquire should not hold permits")
+	}
+}
+
+func TestKeyedSemaphore(t *testing.T) {
+	ks := NewKeyedSemaphore(2)
+	if !ks.TryAcquire("user1", 2) {
+		t.Error("TryAcquire failed with enough permits available")
+	}
+	if ks.TryAcquire("user1", 1) {
+		t.Error("TryAcquire succeeded without enough permits available")
+	}
+	if !ks.TryAcquire("user2", 1) {
+		t.Error("Keys should not share permits")
+	}
+	if ks.Len() != 2 {
+		t.Error("Incorrect number of keys:", ks.Len())
+	}
+	ks.Release("user1", 2)
+	ks.Release("user2", 1)
+	if ks.Len() != 0 {
+		t.Error("Keys should be removed when no permits are held")
+	}
+}
@@ -0,0 +1,188 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"sync"
+	"time"
+)
+
+// Shaper is an implementation of the leaky bucket algorithm as a meter: it
+// spaces operations at a constant interval, queueing callers until their slot
+// arrives.
+//
+// Unlike TBucketQ, which releases waiters in bursts each tick, a Shaper emits
+// at most one operation per interval. A slack may be configured to allow a
+// limited burst after a period of inactivity.
+//
+// To learn more about the leaky bucket algorithm, visit:
+// https://en.wikipedia.org/wiki/Leaky_bucket
+type Shaper struct {
+	// per is the interval between operations
+	per time.Duration
+	// slack is the maximum amount of unused time that may be banked
+	slack time.Duration
+	// maxq is the maximum number of callers waiting for a slot
+	maxq int64
+	// mu is the mutex for accessing next and qcnt
+	mu sync.Mutex
+	// next is the time of the next available slot
+	next time.Time
+	// qcnt is the number of callers waiting for a slot
+	qcnt int64
+	// cch is closed when the shaper is closed
+	cch chan struct{}
+	// closed indicates whether the shaper is closed
+	closed bool
+}
+
+// NewShaper returns an initialized Shaper pointer that allows one operation
+// every "per", with at most "maxq" callers waiting for a slot. Using this
+// function is equivilant to calling NewSlackShaper(per, 0, maxq).
+func NewShaper(per time.Duration, maxq int64) *Shaper {
+	return NewSlackShaper(per, 0, maxq)
+}
+
+// NewSlackShaper returns an initialized Shaper pointer that allows one
+// operation every "per", with at most "maxq" callers waiting for a slot.
+//
+// The parameter "slack" is the number of unused slots that may be banked while
+// the Shaper is idle, and used immediately afterwards.
+func NewSlackShaper(per time.Duration, slack, maxq int64) *Shaper {
+	if per < 0 {
+		per = 0
+	}
+	if slack < 0 {
+		slack = 0
+	}
+	if maxq < 0 {
+		maxq = 0
+	}
+	return &Shaper{
+		per:   per,
+		slack: per * time.Duration(slack),
+		maxq:  maxq,
+		cch:   make(chan struct{}),
+	}
+}
+
+// Take blocks until the next slot is available.
+//
+// It returns true once the caller may proceed, or false immediately if the
+// queue is full, or when the Shaper is closed.
+func (s *Shaper) Take() bool {
+	return s.TakeN(1)
+}
+
+// TakeN blocks until the next slot is available, and reserves it along with
+// the following "n"-1 slots, so that the next operation is delayed by "n"
+// intervals. See Take for more information.
+func (s *Shaper) TakeN(n int64) bool {
+	wait, ok := s.reserve(n, true)
+	if !ok {
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.cch:
+		s.mu.Lock()
+		s.qcnt -= 1
+		s.mu.Unlock()
+		return false
+	}
+	s.mu.Lock()
+	s.qcnt -= 1
+	s.mu.Unlock()
+	return true
+}
+
+// TryTake attempts to take a slot without waiting. It returns true if a slot
+// was available, or false otherwise.
+func (s *Shaper) TryTake() bool {
+	return s.TryTakeN(1)
+}
+
+// TryTakeN attempts to take "n" slots without waiting. It returns true if the
+// next slot was available, or false otherwise.
+func (s *Shaper) TryTakeN(n int64) bool {
+	_, ok := s.reserve(n, false)
+	return ok
+}
+
+// reserve reserves the next "n" slots, returning the duration until the first
+// one arrives. If "queue" is false, only a slot that is available now will be
+// reserved.
+func (s *Shaper) reserve(n int64, queue bool) (time.Duration, bool) {
+	if n < 1 {
+		n = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, false
+	}
+	now := time.Now()
+	slot := s.next
+	// don't bank more unused time than the slack allows
+	if min := now.Add(-s.slack); slot.Before(min) {
+		slot = min
+	}
+	wait := slot.Sub(now)
+	if wait > 0 {
+		if !queue || s.qcnt >= s.maxq {
+			return 0, false
+		}
+		s.qcnt += 1
+	}
+	s.next = slot.Add(s.per * time.Duration(n))
+	return wait, true
+}
+
+// Close permanently closes the Shaper, waking any waiting callers. Subsequent
+// calls to Take or TryTake will return false.
+//
+// It returns true if the Shaper has been closed, or false if the Shaper has
+// already been closed.
+func (s *Shaper) Close() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	close(s.cch)
+	return true
+}
+
+// IsClosed returns true if the Shaper has been closed. It returns false if it
+// is still open.
+func (s *Shaper) IsClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
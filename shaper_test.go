@@ -0,0 +1,104 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShaperTake(t *testing.T) {
+	s := NewShaper(time.Millisecond*10, 10)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if !s.Take() {
+			t.Error("Take returned false with room in the queue")
+		}
+		if dur := time.Since(start); dur < time.Millisecond*10*time.Duration(i) {
+			t.Error("Take did not space operations:", i, dur)
+		}
+	}
+	if dur := time.Since(start); dur < time.Millisecond*40 || dur > time.Millisecond*80 {
+		t.Error("Incorrect timing of operations:", dur)
+	}
+}
+
+func TestShaperQueue(t *testing.T) {
+	s := NewShaper(time.Millisecond*50, 1)
+	if !s.TryTake() {
+		t.Error("TryTake should succeed on an idle Shaper")
+	}
+	if s.TryTake() {
+		t.Error("TryTake should fail before the next slot")
+	}
+	ch := make(chan bool, 2)
+	go func() { ch <- s.Take() }()
+	time.Sleep(time.Millisecond * 10)
+	if s.Take() {
+		t.Error("Take should fail when the queue is full")
+	}
+	if !<-ch {
+		t.Error("Queued Take should succeed")
+	}
+	go func() { ch <- s.Take() }()
+	time.Sleep(time.Millisecond * 10)
+	s.Close()
+	if <-ch {
+		t.Error("Close should wake queued callers with false")
+	}
+	if s.Take() || !s.IsClosed() {
+		t.Error("Take should fail on a closed Shaper")
+	}
+}
+
+func TestShaperSlack(t *testing.T) {
+	s := NewSlackShaper(time.Millisecond*20, 3, 0)
+	s.TryTake()
+	time.Sleep(time.Millisecond * 100)
+	var oks int
+	for i := 0; i < 10; i++ {
+		if s.TryTake() {
+			oks += 1
+		}
+	}
+	if oks != 4 {
+		t.Error("Incorrect number of slots with slack:", oks)
+	}
+}
+
+func TestShaperTakeN(t *testing.T) {
+	s := NewShaper(time.Millisecond*10, 10)
+	start := time.Now()
+	if !s.TakeN(5) {
+		t.Error("TakeN should succeed on an idle Shaper")
+	}
+	if s.TryTakeN(1) {
+		t.Error("TryTakeN should fail before the reserved slots have passed")
+	}
+	if !s.Take() {
+		t.Error("Take returned false with room in the queue")
+	}
+	if dur := time.Since(start); dur < time.Millisecond*50 {
+		t.Error("TakeN did not reserve its slots:", dur)
+	}
+}
@@ -0,0 +1,240 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limShard is a single shard of a ShardedLimiterOf.
+type limShard[K comparable] struct {
+	// mu is the mutex for accessing cache
+	mu sync.Mutex
+	// cache holds the count for each key in the shard
+	cache map[K]int64
+	// pad prevents false sharing between neighbouring shards
+	pad [64]byte
+}
+
+// ShardedLimiterOf limits the number of events per key of type K within a time
+// window, like LimiterOf, but spreads its keys over several shards, each with
+// its own lock, to reduce contention when many goroutines use it at once.
+//
+// Rather than clearing every key at once, the shards are cleared one at a time,
+// staggered evenly over each window of length "dur". Each key is still cleared
+// once per window, but windows are offset from one shard to the next.
+type ShardedLimiterOf[K comparable] struct {
+	// shards are the limiter shards
+	shards []limShard[K]
+	// mask is used to select a shard from a key's hash
+	mask uint64
+	// seed is the seed used to hash keys
+	seed maphash.Seed
+	// max is the maximum count per key
+	max int64
+	// ticker is the timer that clears the next shard
+	ticker *time.Ticker
+	// cch is the channel that listens for a close event
+	cch chan struct{}
+	// closed indicates whether the limiter is closed (1) or not (0)
+	closed uint32
+	// tracker tracks the heaviest keys, if enabled
+	tracker atomic.Pointer[keyTracker[K]]
+}
+
+// ShardedLimiter is a ShardedLimiterOf with string keys.
+type ShardedLimiter = ShardedLimiterOf[string]
+
+// NewShardedLimiter returns an initialized ShardedLimiter pointer that allows
+// at most "max" events per key within each window of length "dur".
+func NewShardedLimiter(max int64, dur time.Duration) *ShardedLimiter {
+	return NewShardedLimiterOf[string](max, dur)
+}
+
+// NewShardedLimiterOf returns an initialized ShardedLimiterOf pointer that
+// allows at most "max" events per key within each window of length "dur". The
+// number of shards is four times GOMAXPROCS, rounded up to a power of two.
+func NewShardedLimiterOf[K comparable](max int64, dur time.Duration) *ShardedLimiterOf[K] {
+	n := 1
+	for n < runtime.GOMAXPROCS(0)*4 {
+		n <<= 1
+	}
+	interval := dur / time.Duration(n)
+	if interval <= 0 {
+		interval = 1
+	}
+	lim := &ShardedLimiterOf[K]{
+		shards: make([]limShard[K], n),
+		mask:   uint64(n - 1),
+		seed:   maphash.MakeSeed(),
+		max:    max,
+		ticker: time.NewTicker(interval),
+		cch:    make(chan struct{}, 1),
+	}
+	for i := range lim.shards {
+		lim.shards[i].cache = make(map[K]int64)
+	}
+	go lim.tick()
+	return lim
+}
+
+// tick clears the next shard each time the ticker goes off, until the limiter
+// is closed.
+func (lim *ShardedLimiterOf[K]) tick() {
+	var next int
+	for {
+		select {
+		case <-lim.ticker.C:
+			lim.shards[next].clear()
+			next = (next + 1) % len(lim.shards)
+			if next == 0 {
+				lim.tracker.Load().reset()
+			}
+		case <-lim.cch:
+			lim.ticker.Stop()
+			lim.ClearAll()
+			return
+		}
+	}
+}
+
+// Close stops the internal ticker that clears the shards, and clears all keys.
+// When the limiter will no longer be used, this function must be called to
+// stop the internal timer from continuing to fire. Like LimiterOf.Close, it
+// has no effect if the limiter has already been closed.
+func (lim *ShardedLimiterOf[K]) Close() {
+	if !atomic.CompareAndSwapUint32(&lim.closed, 0, 1) {
+		return
+	}
+	lim.cch <- struct{}{}
+}
+
+// IsClosed returns true if the limiter has been closed. It returns false if it
+// is still open.
+func (lim *ShardedLimiterOf[K]) IsClosed() bool {
+	return atomic.LoadUint32(&lim.closed) != 0
+}
+
+// Capacity returns the maximum count per key, which is the largest value that
+// can be added at once.
+func (lim *ShardedLimiterOf[K]) Capacity() int64 {
+	return lim.max
+}
+
+// Inc increments the count for "key" by 1. It returns true if the new count
+// does not exceed the maximum, or false (leaving the count unchanged)
+// otherwise.
+func (lim *ShardedLimiterOf[K]) Inc(key K) bool {
+	return lim.IncBy(key, 1)
+}
+
+// IncBy increments the count for "key" by "val". It returns true if the new
+// count does not exceed the maximum, or false (leaving the count unchanged)
+// otherwise.
+func (lim *ShardedLimiterOf[K]) IncBy(key K, val int64) bool {
+	ok := lim.incBy(key, val)
+	lim.tracker.Load().observe(key, val, ok)
+	return ok
+}
+
+func (lim *ShardedLimiterOf[K]) incBy(key K, val int64) bool {
+	s := lim.shard(key)
+	s.mu.Lock()
+	if s.cache[key]+val > lim.max {
+		s.mu.Unlock()
+		return false
+	}
+	s.cache[key] += val
+	s.mu.Unlock()
+	return true
+}
+
+// Dec decrements the count for "key" by 1.
+func (lim *ShardedLimiterOf[K]) Dec(key K) bool {
+	return lim.IncBy(key, -1)
+}
+
+// DecBy decrements the count for "key" by "val".
+func (lim *ShardedLimiterOf[K]) DecBy(key K, val int64) bool {
+	return lim.IncBy(key, -val)
+}
+
+// Clear removes the count for "key".
+func (lim *ShardedLimiterOf[K]) Clear(key K) {
+	s := lim.shard(key)
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+}
+
+// ClearAll removes the counts for all keys, one shard at a time.
+func (lim *ShardedLimiterOf[K]) ClearAll() {
+	for i := range lim.shards {
+		lim.shards[i].clear()
+	}
+}
+
+// TrackTopKeys enables tracking of the heaviest keys, by requested and by denied
+// counts, monitoring at most "capacity" keys each. Counts are reset every
+// window. Calling it again resets the counts.
+//
+// Tracking uses a single lock shared by all shards.
+func (lim *ShardedLimiterOf[K]) TrackTopKeys(capacity int) {
+	lim.tracker.Store(newKeyTracker[K](capacity))
+}
+
+// TopKeys returns the "k" keys with the highest requested counts in the current
+// window, or nil if TrackTopKeys has not been called.
+func (lim *ShardedLimiterOf[K]) TopKeys(k int) []KeyCount[K] {
+	if kt := lim.tracker.Load(); kt != nil {
+		return kt.volume.Top(k)
+	}
+	return nil
+}
+
+// TopDenied returns the "k" keys with the highest denied counts in the current
+// window, or nil if TrackTopKeys has not been called.
+func (lim *ShardedLimiterOf[K]) TopDenied(k int) []KeyCount[K] {
+	if kt := lim.tracker.Load(); kt != nil {
+		return kt.denials.Top(k)
+	}
+	return nil
+}
+
+// shard returns the shard for "key".
+func (lim *ShardedLimiterOf[K]) shard(key K) *limShard[K] {
+	return &lim.shards[maphash.Comparable(lim.seed, key)&lim.mask]
+}
+
+// clear removes the counts for all keys in the shard.
+func (s *limShard[K]) clear() {
+	s.mu.Lock()
+	if len(s.cache) > 0 {
+		s.cache = make(map[K]int64)
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,105 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShardedLimiterInc(t *testing.T) {
+	lim := NewShardedLimiter(10, time.Millisecond*50)
+	defer lim.Close()
+	var oks int
+	for i := 0; i < 15; i++ {
+		if lim.Inc("sample1") {
+			oks += 1
+		}
+	}
+	if oks != 10 {
+		t.Error("Incorrect increment successes")
+	}
+	if !lim.Inc("sample2") {
+		t.Error("Keys should not share counts")
+	}
+	time.Sleep(time.Millisecond * 70)
+	if !lim.Inc("sample1") {
+		t.Error("Counts should be cleared after the window")
+	}
+}
+
+func TestShardedLimiterClear(t *testing.T) {
+	lim := NewShardedLimiterOf[int](1, time.Second)
+	lim.Inc(1)
+	lim.Inc(2)
+	lim.Clear(1)
+	if !lim.Inc(1) || lim.Inc(2) {
+		t.Error("Clear should only remove the provided key")
+	}
+	lim.DecBy(1, 1)
+	if !lim.Inc(1) {
+		t.Error("DecBy should decrement the count")
+	}
+	lim.Close()
+	lim.Close()
+	if !lim.IsClosed() {
+		t.Error("IsClosed should return true after Close")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if !lim.Inc(2) {
+		t.Error("Close should clear all keys")
+	}
+}
+
+var benchKeys = func() []string {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+func BenchmarkLimiterParallel(b *testing.B) {
+	lim := NewLimiter(1<<62, time.Hour)
+	defer lim.Close()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			lim.Inc(benchKeys[i&1023])
+			i++
+		}
+	})
+}
+
+func BenchmarkShardedLimiterParallel(b *testing.B) {
+	lim := NewShardedLimiter(1<<62, time.Hour)
+	defer lim.Close()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			lim.Inc(benchKeys[i&1023])
+			i++
+		}
+	})
+}
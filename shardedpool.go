@@ -0,0 +1,148 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// poolShard is a single shard of a ShardedPool.
+type poolShard[T any] struct {
+	// mu is the mutex for accessing items
+	mu sync.Mutex
+	// items holds the idle items in the shard
+	items []T
+	// size is the number of idle items, readable without holding mu
+	size int64
+	// max is the maximum number of idle items in the shard
+	max int
+	// pad prevents false sharing between neighbouring shards
+	pad [64]byte
+}
+
+// ShardedPool is a pool of reusable items of type T that spreads its idle
+// items over several shards, each with its own lock, to reduce contention when
+// many goroutines call Get and Put at once.
+//
+// Each call picks a random shard, and steals from (or spills over to) the
+// other shards when it is empty (or full). The maximum number of idle items is
+// split across the shards, so it holds globally.
+type ShardedPool[T any] struct {
+	// shards are the pool shards
+	shards []poolShard[T]
+	// new creates an item when the pool is empty
+	new func() T
+}
+
+// NewShardedPool returns an initialized ShardedPool pointer that holds at most
+// "max" idle items, and uses "new" to create items when the pool is empty. The
+// number of shards is GOMAXPROCS, or "max" if smaller.
+func NewShardedPool[T any](max int64, new func() T) *ShardedPool[T] {
+	if max < 1 {
+		max = 1
+	}
+	n := int64(runtime.GOMAXPROCS(0))
+	if n > max {
+		n = max
+	}
+	sp := &ShardedPool[T]{
+		shards: make([]poolShard[T], n),
+		new:    new,
+	}
+	for i := range sp.shards {
+		// split max evenly, giving the remainder to the first shards
+		smax := int(max / n)
+		if int64(i) < max%n {
+			smax += 1
+		}
+		sp.shards[i].max = smax
+		sp.shards[i].items = make([]T, 0, smax)
+	}
+	return sp
+}
+
+// Get returns an idle item from the pool, or creates a new one with the
+// provided "new" function if the pool is empty.
+func (sp *ShardedPool[T]) Get() T {
+	n := len(sp.shards)
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		s := &sp.shards[(start+i)%n]
+		if atomic.LoadInt64(&s.size) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		if l := len(s.items); l > 0 {
+			v := s.items[l-1]
+			var zero T
+			s.items[l-1] = zero
+			s.items = s.items[:l-1]
+			atomic.AddInt64(&s.size, -1)
+			s.mu.Unlock()
+			return v
+		}
+		s.mu.Unlock()
+	}
+	return sp.new()
+}
+
+// Put returns an item to the pool. If the pool is full, the item is discarded.
+func (sp *ShardedPool[T]) Put(item T) {
+	n := len(sp.shards)
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		s := &sp.shards[(start+i)%n]
+		if atomic.LoadInt64(&s.size) >= int64(s.max) {
+			continue
+		}
+		s.mu.Lock()
+		if len(s.items) < s.max {
+			s.items = append(s.items, item)
+			atomic.AddInt64(&s.size, 1)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+	// pool is full, discard item
+}
+
+// Use calls "f" with an item from the pool, returning it to the pool
+// afterwards.
+func (sp *ShardedPool[T]) Use(f func(T)) {
+	v := sp.Get()
+	f(v)
+	sp.Put(v)
+}
+
+// Len returns the number of idle items in the pool.
+func (sp *ShardedPool[T]) Len() int64 {
+	var n int64
+	for i := range sp.shards {
+		n += atomic.LoadInt64(&sp.shards[i].size)
+	}
+	return n
+}
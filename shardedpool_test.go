@@ -0,0 +1,103 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func newTestBuffer() *bytes.Buffer {
+	return new(bytes.Buffer)
+}
+
+func TestShardedPool(t *testing.T) {
+	sp := NewShardedPool(5, newTestBuffer)
+	bufArr := [10]*bytes.Buffer{}
+	for i := 0; i < 10; i++ {
+		bufArr[i] = sp.Get()
+	}
+	for i := 0; i < 10; i++ {
+		sp.Put(bufArr[i])
+	}
+	if sp.Len() != 5 {
+		t.Error("Incorrect pool size:", sp.Len())
+	}
+	for i := 0; i < 5; i++ {
+		sp.Get()
+	}
+	if sp.Len() != 0 {
+		t.Error("Get should steal items from every shard:", sp.Len())
+	}
+}
+
+func TestShardedPoolStress(t *testing.T) {
+	sp := NewShardedPool(16, newTestBuffer)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				buf := sp.Get()
+				if buf == nil {
+					t.Error("Get returned a nil item")
+					return
+				}
+				sp.Put(buf)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := sp.Len(); n < 1 || n > 16 {
+		t.Error("Incorrect pool size:", n)
+	}
+}
+
+func BenchmarkShardedPoolParallel(b *testing.B) {
+	sp := NewShardedPool(1024, newTestBuffer)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sp.Put(sp.Get())
+		}
+	})
+}
+
+func BenchmarkPoolParallel(b *testing.B) {
+	p := NewPoolOf(1024, newTestBuffer)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.Put(p.Get())
+		}
+	})
+}
+
+func BenchmarkSyncPoolParallel(b *testing.B) {
+	p := sync.Pool{New: func() interface{} { return newTestBuffer() }}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.Put(p.Get())
+		}
+	})
+}
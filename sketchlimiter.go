@@ -0,0 +1,207 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// SketchLimiterOf limits the number of events per key of type K within a time
+// window, like LimiterOf, but uses a fixed amount of memory however many
+// distinct keys are seen.
+//
+// Counts are kept in a count-min sketch, so they may be overestimated (but
+// never underestimated) when keys collide: a key may occasionally be limited
+// early, but never late. A larger width reduces the overestimate, and a larger
+// depth reduces the probability of it. All counts are cleared every window.
+//
+// To learn more about the count-min sketch, visit:
+// https://en.wikipedia.org/wiki/Count%E2%80%93min_sketch
+type SketchLimiterOf[K comparable] struct {
+	// counts holds the sketch, depth rows of width counters
+	counts []int64
+	// width is the number of counters in each row
+	width uint64
+	// depth is the number of rows
+	depth uint64
+	// seed is the seed used to hash keys
+	seed maphash.Seed
+	// mu is the mutex for accessing counts
+	mu sync.Mutex
+	// max is the maximum count per key
+	max int64
+	// ticker is the timer that clears the sketch
+	ticker *time.Ticker
+	// cch is the channel that listens for a close event
+	cch chan struct{}
+	// closed indicates whether the limiter is closed
+	closed bool
+}
+
+// SketchLimiter is a SketchLimiterOf with string keys.
+type SketchLimiter = SketchLimiterOf[string]
+
+// NewSketchLimiter returns an initialized SketchLimiter pointer. See
+// NewSketchLimiterOf for more information.
+func NewSketchLimiter(max int64, dur time.Duration, width, depth int) *SketchLimiter {
+	return NewSketchLimiterOf[string](max, dur, width, depth)
+}
+
+// NewSketchLimiterOf returns an initialized SketchLimiterOf pointer that
+// allows at most "max" events per key, clearing all counts every "dur".
+//
+// The parameters "width" and "depth" are the dimensions of the sketch, which
+// uses width*depth counters. If smaller than 1, the values 1024 and 4 will be
+// used respectively.
+func NewSketchLimiterOf[K comparable](max int64, dur time.Duration, width, depth int) *SketchLimiterOf[K] {
+	if width < 1 {
+		width = 1024
+	}
+	if depth < 1 {
+		depth = 4
+	}
+	lim := &SketchLimiterOf[K]{
+		counts: make([]int64, width*depth),
+		width:  uint64(width),
+		depth:  uint64(depth),
+		seed:   maphash.MakeSeed(),
+		max:    max,
+		ticker: time.NewTicker(dur),
+		cch:    make(chan struct{}, 1),
+	}
+	go lim.tick()
+	return lim
+}
+
+func (lim *SketchLimiterOf[K]) tick() {
+	for {
+		select {
+		case <-lim.ticker.C:
+			lim.ClearAll()
+		case <-lim.cch:
+			lim.ticker.Stop()
+			lim.ClearAll()
+			return
+		}
+	}
+}
+
+// Close stops the internal ticker that clears the counts. When the limiter
+// will no longer be used, this function must be called to stop the internal
+// timer from continuing to fire. Like LimiterOf.Close, it has no effect if the
+// limiter has already been closed.
+func (lim *SketchLimiterOf[K]) Close() {
+	lim.mu.Lock()
+	if lim.closed {
+		lim.mu.Unlock()
+		return
+	}
+	lim.closed = true
+	lim.mu.Unlock()
+	lim.cch <- struct{}{}
+}
+
+// IsClosed returns true if the limiter has been closed. It returns false if it
+// is still open.
+func (lim *SketchLimiterOf[K]) IsClosed() bool {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.closed
+}
+
+// Capacity returns the maximum count per key, which is the largest value that
+// can be added at once.
+func (lim *SketchLimiterOf[K]) Capacity() int64 {
+	return lim.max
+}
+
+// Inc increments the count for "key" by 1. It returns true if the new count
+// does not exceed the maximum, or false (leaving the count unchanged)
+// otherwise.
+func (lim *SketchLimiterOf[K]) Inc(key K) bool {
+	return lim.IncBy(key, 1)
+}
+
+// IncBy increments the count for "key" by "val", which must be positive. It
+// returns true if the new count does not exceed the maximum, or false (leaving
+// the count unchanged) otherwise.
+func (lim *SketchLimiterOf[K]) IncBy(key K, val int64) bool {
+	if val < 1 {
+		return false
+	}
+	h1, h2 := lim.hash(key)
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	est := lim.estimate(h1, h2)
+	if est+val > lim.max {
+		return false
+	}
+	// conservative update: only raise the counters that are below the new
+	// estimate, which reduces the overestimate for colliding keys
+	for i := uint64(0); i < lim.depth; i++ {
+		if c := &lim.counts[lim.index(i, h1, h2)]; *c < est+val {
+			*c = est + val
+		}
+	}
+	return true
+}
+
+// Estimate returns the estimated count for "key" in the current window.
+func (lim *SketchLimiterOf[K]) Estimate(key K) int64 {
+	h1, h2 := lim.hash(key)
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.estimate(h1, h2)
+}
+
+// ClearAll removes the counts for all keys.
+func (lim *SketchLimiterOf[K]) ClearAll() {
+	lim.mu.Lock()
+	clear(lim.counts)
+	lim.mu.Unlock()
+}
+
+// hash returns the two hashes of "key" used to derive its counter in each row.
+func (lim *SketchLimiterOf[K]) hash(key K) (uint64, uint64) {
+	h := maphash.Comparable(lim.seed, key)
+	return h, (h >> 32) | (h << 32) | 1
+}
+
+// index returns the index of the counter in row "i" for the provided hashes.
+func (lim *SketchLimiterOf[K]) index(i, h1, h2 uint64) uint64 {
+	return i*lim.width + (h1+i*h2)%lim.width
+}
+
+// estimate returns the minimum of the counters for the provided hashes. The
+// caller must hold lim.mu.
+func (lim *SketchLimiterOf[K]) estimate(h1, h2 uint64) int64 {
+	est := lim.counts[lim.index(0, h1, h2)]
+	for i := uint64(1); i < lim.depth; i++ {
+		if c := lim.counts[lim.index(i, h1, h2)]; c < est {
+			est = c
+		}
+	}
+	return est
+}
@@ -0,0 +1,63 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSketchLimiterInc(t *testing.T) {
+	lim := NewSketchLimiter(10, time.Second, 0, 0)
+	defer lim.Close()
+	var oks int
+	for i := 0; i < 15; i++ {
+		if lim.Inc("sample1") {
+			oks += 1
+		}
+	}
+	if oks != 10 {
+		t.Error("Incorrect increment successes")
+	}
+	if lim.Estimate("sample1") != 10 {
+		t.Error("Incorrect estimate:", lim.Estimate("sample1"))
+	}
+	lim.ClearAll()
+	if !lim.Inc("sample1") {
+		t.Error("ClearAll should clear the counts")
+	}
+}
+
+func TestSketchLimiterNeverUnderestimates(t *testing.T) {
+	lim := NewSketchLimiterOf[string](1000, time.Second, 64, 4)
+	defer lim.Close()
+	for i := 0; i < 500; i++ {
+		lim.IncBy("key"+strconv.Itoa(i), int64(i%7+1))
+	}
+	for i := 0; i < 500; i++ {
+		if est := lim.Estimate("key" + strconv.Itoa(i)); est < int64(i%7+1) {
+			t.Error("Estimate below the actual count:", i, est)
+		}
+	}
+}
@@ -112,20 +112,29 @@ func (tb *TBucket) tick() {
 			}
 		case <-tb.ticker.C:
 			// timer event, attempt to add token(s) to the bucket
-			var done bool
-			for !done {
-				// add token(s) to the bucket if not already full
-				if toks := atomic.LoadInt64(&tb.tokens); toks < tb.bsize {
-					if toks+tb.burst >= tb.bsize {
-						done = atomic.CompareAndSwapInt64(&tb.tokens, toks, tb.bsize)
-					} else {
-						done = atomic.CompareAndSwapInt64(&tb.tokens, toks, toks+tb.burst)
-					}
-				} else {
-					// bucket is full, throw token(s) away
-					done = true
-				}
+			tb.AddToks(tb.burst)
+		}
+	}
+}
+
+// AddToks adds "n" tokens to the bucket, without exceeding the defined bucket
+// size. It can be used to return unused tokens, or to grant tokens in response
+// to an event rather than the passing of time.
+func (tb *TBucket) AddToks(n int64) {
+	if n < 1 {
+		return
+	}
+	var done bool
+	for !done {
+		if toks := atomic.LoadInt64(&tb.tokens); toks < tb.bsize {
+			if toks+n >= tb.bsize {
+				done = atomic.CompareAndSwapInt64(&tb.tokens, toks, tb.bsize)
+			} else {
+				done = atomic.CompareAndSwapInt64(&tb.tokens, toks, toks+n)
 			}
+		} else {
+			// bucket is full, throw token(s) away
+			done = true
 		}
 	}
 }
@@ -189,7 +198,8 @@ func (tb *TBucket) GetTok() bool {
 // false if there are not enough tokens available.
 //
 // The provided parameter "n" cannot be smaller than 1. If a smaller value is
-// provided, the value 1 will be used.
+// provided, the value 1 will be used. Use TryGetToks to tell apart a request
+// that is larger than the bucket size from one that should be tried later.
 func (tb *TBucket) GetToks(n int64) bool {
 	// if the provided value is less than 1, return false
 	if n < 1 {
@@ -206,6 +216,31 @@ func (tb *TBucket) GetToks(n int64) bool {
 	return true
 }
 
+// TryGetToks attempts to retrieve "n" tokens from the bucket.
+//
+// It returns nil if the tokens have been retrieved, or if "n" is smaller than
+// 1. If "n" is larger than the bucket size, ErrTooLarge is returned, since the
+// request can never succeed. Otherwise, ErrLimited is returned if there are
+// not enough tokens available.
+func (tb *TBucket) TryGetToks(n int64) error {
+	if n < 1 {
+		return nil
+	}
+	if n > tb.bsize {
+		return ErrTooLarge
+	}
+	if !tb.GetToks(n) {
+		return ErrLimited
+	}
+	return nil
+}
+
+// Capacity returns the bucket size, which is the largest number of tokens that
+// can be retrieved at once.
+func (tb *TBucket) Capacity() int64 {
+	return tb.bsize
+}
+
 // IsClosed returns true if the TBucket has been closed. It returns false if
 // it is still open.
 func (tb *TBucket) IsClosed() bool {
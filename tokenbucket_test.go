@@ -123,6 +123,20 @@ func TestTBucketFill(t *testing.T) {
 	}
 }
 
+func TestTBucketAddToks(t *testing.T) {
+	tb := NewTBucket(10, time.Second)
+	tb.Pause()
+	tb.FillTo(5)
+	tb.AddToks(3)
+	if atomic.LoadInt64(&tb.tokens) != 8 {
+		t.Error("Incorrect number of tokens in bucket after calling AddToks")
+	}
+	tb.AddToks(5)
+	if atomic.LoadInt64(&tb.tokens) != 10 {
+		t.Error("AddToks should not exceed the bucket size")
+	}
+}
+
 func TestTBucketGetTok(t *testing.T) {
 	tb := NewTBucket(10, time.Second)
 	var oks int
@@ -212,3 +226,17 @@ func BenchmarkGetPSuc(b *testing.B) {
 		tb.GetTok()
 	}
 }
+
+func TestTBucketTryGetToks(t *testing.T) {
+	tb := NewTBucket(5, time.Hour)
+	defer tb.Close()
+	if err := tb.TryGetToks(6); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got:", err)
+	}
+	if err := tb.TryGetToks(5); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := tb.TryGetToks(1); err != ErrLimited {
+		t.Error("Expected ErrLimited, got:", err)
+	}
+}
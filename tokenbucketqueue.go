@@ -23,10 +23,50 @@
 package ratelim
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ErrQueueFull is returned when a request cannot wait because the queue is
+// full.
+var ErrQueueFull = errors.New("ratelim: queue is full")
+
+// QueueClass is a single priority class of a TBucketQ.
+type QueueClass struct {
+	// MaxQ is the maximum number of tokens waited for in the class
+	MaxQ int64
+	// Weight is the share of tokens granted to the class when other classes
+	// are waiting too
+	Weight int
+}
+
+// tbqWaiter represents a single request waiting in a TBucketQ class.
+type tbqWaiter struct {
+	// need is the number of tokens still to be granted
+	need int64
+	// got is the number of tokens granted so far
+	got int64
+	// ready is closed once all tokens have been granted
+	ready chan struct{}
+}
+
+// tbqClass is the queue of a single priority class of a TBucketQ.
+type tbqClass struct {
+	// maxq is the maximum number of tokens waited for in the class
+	maxq int64
+	// qcnt is the number of tokens waited for in the class
+	qcnt int64
+	// weight is the share of tokens granted to the class
+	weight int
+	// current is the class's running weight for smooth weighted round robin
+	current int
+	// waiters is the FIFO queue of requests in the class
+	waiters ListOf[*tbqWaiter]
+}
+
 type TBucketQ struct {
 	// number of tokens in the bucket (i.e. available tokens)
 	tokens int64
@@ -34,11 +74,13 @@ type TBucketQ struct {
 	bsize int64
 	// burst is the number of tokens to add to the bucket each 'tick'
 	burst int64
-	// qch is the channel over which requests are queued
-	qch chan struct{}
-	// maxq is the maximum size of the request queue
+	// mu is the mutex for accessing classes
+	mu sync.Mutex
+	// classes holds the queue of each priority class, highest first
+	classes []tbqClass
+	// maxq is the maximum size of the request queue, across all classes
 	maxq int64
-	// qcnt is the number of requests waiting in the queue
+	// qcnt is the number of tokens waited for, across all classes
 	qcnt int64
 	// ticker contains the channel for adding tokens to the bucket
 	ticker *time.Ticker
@@ -59,6 +101,20 @@ func NewTBucketQ(bsize int64, dur time.Duration, maxq int64) *TBucketQ {
 }
 
 func NewBurstyTBucketQ(bsize, burst int64, dur time.Duration, maxq int64) *TBucketQ {
+	return NewPriorityTBucketQ(bsize, burst, dur, QueueClass{MaxQ: maxq, Weight: 1})
+}
+
+// NewPriorityTBucketQ returns a new token bucket with the specified maximum
+// bucket size, the number of tokens added every time interval "dur", and a
+// queue for each of the provided priority classes, from highest to lowest
+// priority. If no class is provided, a single class without a queue is used.
+//
+// When tokens are added to the bucket, they are granted to waiting requests by
+// smooth weighted round robin across the classes that have requests waiting,
+// so that lower priorities are served less often but never starved. A class
+// with a Weight smaller than 1 is given twice the weight of the class after
+// it, with the lowest class having a weight of 1 (e.g. 4, 2 and 1).
+func NewPriorityTBucketQ(bsize, burst int64, dur time.Duration, classes ...QueueClass) *TBucketQ {
 	// verify burst and maxq are acceptable values
 	if bsize < 1 {
 		bsize = 1
@@ -66,19 +122,32 @@ func NewBurstyTBucketQ(bsize, burst int64, dur time.Duration, maxq int64) *TBuck
 	if burst < 1 {
 		burst = 1
 	}
-	if maxq < 0 {
-		maxq = 0
+	if len(classes) == 0 {
+		classes = []QueueClass{{}}
 	}
 	// create token bucket queue
 	tbq := &TBucketQ{
-		tokens: bsize,
-		bsize:  bsize,
-		burst:  burst,
-		qch:    make(chan struct{}, 1),
-		maxq:   maxq,
-		ticker: time.NewTicker(dur),
-		cch:    make(chan struct{}, 1),
-		prch:   make(chan struct{}, 1),
+		tokens:  bsize,
+		bsize:   bsize,
+		burst:   burst,
+		classes: make([]tbqClass, len(classes)),
+		ticker:  time.NewTicker(dur),
+		cch:     make(chan struct{}, 1),
+		prch:    make(chan struct{}, 1),
+	}
+	weight := 1
+	for i := len(classes) - 1; i >= 0; i-- {
+		c := classes[i]
+		if c.MaxQ < 0 {
+			c.MaxQ = 0
+		}
+		if c.Weight > 0 {
+			weight = c.Weight
+		} else if i < len(classes)-1 {
+			weight *= 2
+		}
+		tbq.classes[i] = tbqClass{maxq: c.MaxQ, weight: weight}
+		tbq.maxq += c.MaxQ
 	}
 	// receive from ticker
 	go tbq.tick()
@@ -105,38 +174,11 @@ func (tbq *TBucketQ) tick() {
 				// resume event received
 			}
 		case <-tbq.ticker.C:
-			// add token to queue channel if there are any requests waiting
-			burst := tbq.burst
-			if atomic.LoadInt64(&tbq.qcnt) > 0 {
-				for i := int64(0); i < tbq.burst; i++ {
-					if qcnt := atomic.LoadInt64(&tbq.qcnt); qcnt > 0 {
-						tbq.qch <- struct{}{}
-						atomic.AddInt64(&tbq.qcnt, -1)
-						burst -= 1
-					} else {
-						continue
-					}
-				}
-			}
-			if burst == 0 {
-				continue
-			}
-			// no requests remaining in queue, attempt to add
-			// token(s) to the bucket
-			var done bool
-			for !done {
-				// add token(s) to the bucket if not already full
-				if toks := atomic.LoadInt64(&tbq.tokens); toks < tbq.bsize {
-					if toks+burst >= tbq.bsize {
-						done = atomic.CompareAndSwapInt64(&tbq.tokens, toks, tbq.bsize)
-					} else {
-						done = atomic.CompareAndSwapInt64(&tbq.tokens, toks, toks+burst)
-					}
-				} else {
-					// bucket is full, throw token(s) away
-					done = true
-				}
-			}
+			// grant token(s) to requests waiting in the queue, then add
+			// the remaining token(s) to the bucket
+			tbq.mu.Lock()
+			tbq.grant(tbq.burst)
+			tbq.mu.Unlock()
 		}
 	}
 }
@@ -158,29 +200,12 @@ func (tbq *TBucketQ) Close() bool {
 
 // request a token; returns true if token obtained, false otherwise
 func (tbq *TBucketQ) GetTok() bool {
-	// attempt to obtain token from bucket
-	for {
-		if toks := atomic.LoadInt64(&tbq.tokens); toks > 0 {
-			if atomic.CompareAndSwapInt64(&tbq.tokens, toks, toks-1) {
-				return true
-			}
-			continue
-		}
-		break
+	// attempt to obtain token from bucket, unless requests are already waiting
+	if atomic.LoadInt64(&tbq.qcnt) == 0 && tbq.GetTokNow() {
+		return true
 	}
-	// no tokens in the bucket, attempt to get on the queue
-	var done bool
-	for !done {
-		if qcnt := atomic.LoadInt64(&tbq.qcnt); qcnt < tbq.maxq {
-			done = atomic.CompareAndSwapInt64(&tbq.qcnt, qcnt, qcnt+1)
-		} else {
-			// queue is full, return false
-			return false
-		}
-	}
-	// on queue, wait until token received
-	<-tbq.qch
-	return true
+	// no tokens in the bucket, wait in the lowest priority class
+	return tbq.wait(context.Background(), len(tbq.classes)-1, 1) == nil
 }
 
 func (tbq *TBucketQ) GetTokNow() bool {
@@ -196,35 +221,206 @@ func (tbq *TBucketQ) GetTokNow() bool {
 	return true
 }
 
-/*
+// GetToks requests "n" tokens, waiting in the queue if they are not available
+// in the bucket. The tokens available in the bucket are taken first, and only
+// the tokens still needed count towards the maximum queue size.
+//
+// It returns true once the tokens have been obtained, or false immediately if
+// the queue is full, if "n" is smaller than 1, or if "n" is larger than the
+// bucket size (see Capacity). Use WaitToks to tell these cases apart.
 func (tbq *TBucketQ) GetToks(n int64) bool {
-	// attempt to obtain token from bucket
+	if n < 1 || n > tbq.bsize {
+		return false
+	}
+	// attempt to obtain tokens from bucket, unless requests are already waiting
+	if atomic.LoadInt64(&tbq.qcnt) == 0 && tbq.GetToksNow(n) {
+		return true
+	}
+	// not enough tokens in the bucket, wait in the lowest priority class
+	return tbq.wait(context.Background(), len(tbq.classes)-1, n) == nil
+}
+
+// TryGetToks attempts to retrieve "n" tokens from the bucket without waiting.
+//
+// It returns nil if the tokens have been retrieved, or if "n" is smaller than
+// 1. If "n" is larger than the bucket size, ErrTooLarge is returned, since the
+// request can never succeed. Otherwise, ErrLimited is returned if there are
+// not enough tokens available.
+func (tbq *TBucketQ) TryGetToks(n int64) error {
+	if n < 1 {
+		return nil
+	}
+	if n > tbq.bsize {
+		return ErrTooLarge
+	}
+	if !tbq.GetToksNow(n) {
+		return ErrLimited
+	}
+	return nil
+}
+
+// WaitToks requests "n" tokens, waiting in the lowest priority class if they
+// are not available in the bucket, as GetToks does. See GetToksPriority for
+// the errors returned.
+func (tbq *TBucketQ) WaitToks(ctx context.Context, n int64) error {
+	return tbq.GetToksPriority(ctx, n, len(tbq.classes)-1)
+}
+
+// GetTokPriority requests a single token, waiting in the queue of priority
+// class "prio" if none is available. See GetToksPriority for more information.
+func (tbq *TBucketQ) GetTokPriority(ctx context.Context, prio int) error {
+	return tbq.GetToksPriority(ctx, 1, prio)
+}
+
+// GetToksPriority requests "n" tokens, waiting in the queue of priority class
+// "prio" if they are not available in the bucket. Class 0 is the highest
+// priority; out of range classes are clamped to the nearest valid one.
+//
+// It returns nil once the tokens have been obtained. If the queue of the class
+// is full, ErrQueueFull is returned immediately, and if "n" is larger than the
+// bucket size, ErrTooLarge is returned. If the context is done first,
+// ctx.Err() is returned and no tokens are held.
+func (tbq *TBucketQ) GetToksPriority(ctx context.Context, n int64, prio int) error {
+	if n < 1 {
+		return nil
+	}
+	if n > tbq.bsize {
+		return ErrTooLarge
+	}
+	if atomic.LoadInt64(&tbq.qcnt) == 0 && tbq.GetToksNow(n) {
+		return nil
+	}
+	prio = min(max(prio, 0), len(tbq.classes)-1)
+	return tbq.wait(ctx, prio, n)
+}
+
+// wait takes the tokens available in the bucket towards a request for "n"
+// tokens, then queues the request in class "c" for the rest, and waits until
+// they have been granted or the context is done.
+func (tbq *TBucketQ) wait(ctx context.Context, c int, n int64) error {
+	tbq.mu.Lock()
+	got := tbq.take(n)
+	if got == n {
+		tbq.mu.Unlock()
+		return nil
+	}
+	class := &tbq.classes[c]
+	need := n - got
+	if class.qcnt+need > class.maxq {
+		tbq.grant(got)
+		tbq.mu.Unlock()
+		return ErrQueueFull
+	}
+	class.qcnt += need
+	atomic.AddInt64(&tbq.qcnt, need)
+	w := &tbqWaiter{need: need, got: got, ready: make(chan struct{})}
+	elem := class.waiters.PushBack(w)
+	tbq.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		tbq.mu.Lock()
+		select {
+		case <-w.ready:
+			// tokens were granted after the context was done, give them
+			// back so the caller doesn't leak them
+			tbq.grant(n)
+		default:
+			class.waiters.Remove(elem)
+			class.qcnt -= w.need
+			atomic.AddInt64(&tbq.qcnt, -w.need)
+			tbq.grant(w.got)
+		}
+		tbq.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// take removes up to "n" tokens from the bucket, returning the number of
+// tokens removed.
+func (tbq *TBucketQ) take(n int64) int64 {
 	for {
-		if toks := atomic.LoadInt64(&tbq.tokens); toks >= n {
-			if atomic.CompareAndSwapInt64(&tbq.tokens, toks, toks-n) {
-				return true
-			}
-			continue
+		toks := atomic.LoadInt64(&tbq.tokens)
+		if toks <= 0 {
+			return 0
+		}
+		got := min(toks, n)
+		if atomic.CompareAndSwapInt64(&tbq.tokens, toks, toks-got) {
+			return got
 		}
-		break
 	}
-	// no tokens in the bucket, attempt to get on the queue
+}
+
+// grant grants "n" tokens to the waiting requests, picking a class for each
+// request by smooth weighted round robin, and adds any remaining tokens to the
+// bucket. The caller must hold tbq.mu.
+func (tbq *TBucketQ) grant(n int64) {
+	for n > 0 {
+		class := tbq.pick()
+		if class == nil {
+			break
+		}
+		front := class.waiters.Front()
+		w := front.Value
+		give := min(n, w.need)
+		w.need -= give
+		w.got += give
+		class.qcnt -= give
+		atomic.AddInt64(&tbq.qcnt, -give)
+		n -= give
+		if w.need == 0 {
+			class.waiters.Remove(front)
+			close(w.ready)
+		}
+	}
+	if n == 0 {
+		return
+	}
+	// no requests remaining in queue, attempt to add token(s) to the bucket
 	var done bool
 	for !done {
-		if qcnt := atomic.LoadInt64(&tbq.qcnt); qcnt+n <= tbq.maxq {
-			done = atomic.CompareAndSwapInt64(&tbq.qcnt, qcnt, qcnt+n)
+		// add token(s) to the bucket if not already full
+		if toks := atomic.LoadInt64(&tbq.tokens); toks < tbq.bsize {
+			if toks+n >= tbq.bsize {
+				done = atomic.CompareAndSwapInt64(&tbq.tokens, toks, tbq.bsize)
+			} else {
+				done = atomic.CompareAndSwapInt64(&tbq.tokens, toks, toks+n)
+			}
 		} else {
-			// queue is full, return false
-			return false
+			// bucket is full, throw token(s) away
+			done = true
 		}
 	}
-	// on queue, wait until token received
-	for i := int64(0); i < n; i++ {
-		<-tbq.qch
+}
+
+// pick returns the next class to be granted a token, or nil if no request is
+// waiting. The caller must hold tbq.mu.
+//
+// Each waiting class adds its weight to its running weight, the class with the
+// highest running weight is picked, and the total weight is subtracted from
+// it. This interleaves the classes in proportion to their weights.
+func (tbq *TBucketQ) pick() *tbqClass {
+	var best *tbqClass
+	var total int
+	for i := range tbq.classes {
+		c := &tbq.classes[i]
+		if c.waiters.Len() == 0 {
+			c.current = 0
+			continue
+		}
+		c.current += c.weight
+		total += c.weight
+		if best == nil || c.current > best.current {
+			best = c
+		}
 	}
-	return true
+	if best != nil {
+		best.current -= total
+	}
+	return best
 }
-*/
 
 func (tbq *TBucketQ) GetToksNow(n int64) bool {
 	// if the provided value is less than 1, return false
@@ -243,6 +439,12 @@ func (tbq *TBucketQ) GetToksNow(n int64) bool {
 	return true
 }
 
+// Capacity returns the bucket size, which is the largest number of tokens that
+// can be requested at once.
+func (tbq *TBucketQ) Capacity() int64 {
+	return tbq.bsize
+}
+
 // IsClosed returns true if the TBucketQ has been closed. It returns false if
 // it is still open.
 func (tbq *TBucketQ) IsClosed() bool {
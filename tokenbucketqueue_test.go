@@ -23,6 +23,7 @@
 package ratelim
 
 import (
+	"context"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -86,3 +87,127 @@ func TestTBucketQGetTok2(t *testing.T) {
 		t.Error("Token bucket shoudl be full at this point")
 	}
 }
+
+func TestTBucketQGetToks(t *testing.T) {
+	tb := NewTBucketQ(10, time.Millisecond*10, 5)
+	defer tb.Close()
+	if tb.GetToks(11) || tb.GetToks(0) {
+		t.Error("GetToks should fail outside of the bucket size")
+	}
+	if tb.Capacity() != 10 {
+		t.Error("Incorrect capacity:", tb.Capacity())
+	}
+	if !tb.GetToks(8) {
+		t.Error("GetToks should succeed with tokens in the bucket")
+	}
+	if tb.GetToks(10) {
+		t.Error("GetToks should fail when the queue cannot hold the request")
+	}
+	t1 := time.Now()
+	if !tb.GetToks(5) {
+		t.Error("GetToks should wait in the queue")
+	}
+	if dur := time.Since(t1); dur < time.Millisecond*20 {
+		t.Error("GetToks did not wait for queued tokens:", dur)
+	}
+}
+
+func TestTBucketQGetToksPartial(t *testing.T) {
+	tb := NewTBucketQ(5, time.Millisecond*20, 10)
+	defer tb.Close()
+	if !tb.GetToksNow(2) {
+		t.Error("GetToksNow should succeed with tokens in the bucket")
+	}
+	// the 3 tokens left in the bucket count towards the request, so only 2
+	// more are waited for
+	t1 := time.Now()
+	if !tb.GetToks(5) {
+		t.Error("GetToks should wait in the queue")
+	}
+	if dur := time.Since(t1); dur < time.Millisecond*30 || dur > time.Millisecond*80 {
+		t.Error("GetToks should only wait for the missing tokens:", dur)
+	}
+	if tb.GetTokNow() {
+		t.Error("Bucket should be empty after the request")
+	}
+}
+
+func TestTBucketQPriority(t *testing.T) {
+	tb := NewPriorityTBucketQ(1, 1, time.Hour, QueueClass{MaxQ: 20, Weight: 3}, QueueClass{MaxQ: 20, Weight: 1})
+	defer tb.Close()
+	tb.GetTokNow()
+	order := make(chan int, 16)
+	for i := 0; i < 8; i++ {
+		for prio := 0; prio < 2; prio++ {
+			go func(prio int) {
+				if err := tb.GetTokPriority(context.Background(), prio); err != nil {
+					t.Error("Unexpected error:", err)
+				}
+				order <- prio
+			}(prio)
+		}
+	}
+	for atomic.LoadInt64(&tb.qcnt) < 16 {
+		time.Sleep(time.Millisecond)
+	}
+	// grant tokens directly, rather than waiting for the ticker
+	tb.mu.Lock()
+	tb.grant(8)
+	tb.mu.Unlock()
+	var first [2]int
+	for i := 0; i < 8; i++ {
+		first[<-order] += 1
+	}
+	if first[0] != 6 || first[1] != 2 {
+		t.Error("Tokens should be granted by weight:", first)
+	}
+	tb.mu.Lock()
+	tb.grant(8)
+	tb.mu.Unlock()
+	for i := 0; i < 8; i++ {
+		<-order
+	}
+}
+
+func TestTBucketQPriorityQueue(t *testing.T) {
+	tb := NewPriorityTBucketQ(2, 1, time.Hour, QueueClass{MaxQ: 1}, QueueClass{MaxQ: 0})
+	defer tb.Close()
+	ctx := context.Background()
+	if err := tb.GetToksPriority(ctx, 3, 0); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got:", err)
+	}
+	if err := tb.GetToksPriority(ctx, 2, 0); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := tb.GetTokPriority(ctx, 1); err != ErrQueueFull {
+		t.Error("Expected ErrQueueFull for a class without a queue, got:", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*20)
+	defer cancel()
+	if err := tb.GetTokPriority(ctx, 0); err != context.DeadlineExceeded {
+		t.Error("Expected context error, got:", err)
+	}
+	if atomic.LoadInt64(&tb.qcnt) != 0 {
+		t.Error("Cancelled requests should leave the queue")
+	}
+}
+
+func TestTBucketQTryGetToks(t *testing.T) {
+	tb := NewTBucketQ(5, time.Hour, 1)
+	defer tb.Close()
+	if err := tb.TryGetToks(6); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got:", err)
+	}
+	if err := tb.WaitToks(context.Background(), 6); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got:", err)
+	}
+	if err := tb.TryGetToks(5); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := tb.TryGetToks(1); err != ErrLimited {
+		t.Error("Expected ErrLimited, got:", err)
+	}
+	if err := tb.WaitToks(context.Background(), 2); err != ErrQueueFull {
+		t.Error("Expected ErrQueueFull, got:", err)
+	}
+}
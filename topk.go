@@ -0,0 +1,192 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// KeyCount is the estimated count for a single key returned by TopK.
+type KeyCount[K comparable] struct {
+	// Key is the key
+	Key K
+	// Count is the estimated count, which may overestimate the actual count
+	// by at most Error
+	Count int64
+	// Error is the maximum overestimate of Count
+	Error int64
+}
+
+// ssEntry is a single monitored key in a TopK.
+type ssEntry[K comparable] struct {
+	KeyCount[K]
+	// index is the position of the entry in the heap
+	index int
+}
+
+// ssHeap is a min-heap of entries ordered by count.
+type ssHeap[K comparable] []*ssEntry[K]
+
+func (h ssHeap[K]) Len() int           { return len(h) }
+func (h ssHeap[K]) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h ssHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *ssHeap[K]) Push(x interface{}) {
+	e := x.(*ssEntry[K])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *ssHeap[K]) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// TopK tracks the most frequent keys of type K in a stream, using a fixed
+// amount of memory.
+//
+// It is an implementation of the Space-Saving algorithm: it monitors at most
+// "capacity" keys, and when a new key arrives while full, it replaces the key
+// with the smallest count. Any key whose actual count exceeds 1/capacity of the
+// total is guaranteed to be monitored.
+//
+// To learn more about the Space-Saving algorithm, see "Efficient Computation of
+// Frequent and Top-k Elements in Data Streams" by Metwally, Agrawal and El
+// Abbadi.
+type TopK[K comparable] struct {
+	// capacity is the maximum number of keys monitored
+	capacity int
+	// mu is the mutex for accessing entries and heap
+	mu sync.Mutex
+	// entries holds the entry for each monitored key
+	entries map[K]*ssEntry[K]
+	// heap orders the entries by count
+	heap ssHeap[K]
+}
+
+// NewTopK returns an initialized TopK pointer that monitors at most "capacity"
+// keys. If "capacity" is smaller than 1, the value 1 will be used.
+func NewTopK[K comparable](capacity int) *TopK[K] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TopK[K]{
+		capacity: capacity,
+		entries:  make(map[K]*ssEntry[K], capacity),
+		heap:     make(ssHeap[K], 0, capacity),
+	}
+}
+
+// Observe adds "n" to the count for "key".
+func (tk *TopK[K]) Observe(key K, n int64) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	if e, ok := tk.entries[key]; ok {
+		e.Count += n
+		heap.Fix(&tk.heap, e.index)
+		return
+	}
+	if len(tk.heap) < tk.capacity {
+		e := &ssEntry[K]{KeyCount: KeyCount[K]{Key: key, Count: n}}
+		tk.entries[key] = e
+		heap.Push(&tk.heap, e)
+		return
+	}
+	// replace the key with the smallest count, which becomes the error
+	// bound of the new key
+	e := tk.heap[0]
+	delete(tk.entries, e.Key)
+	e.Key = key
+	e.Error = e.Count
+	e.Count += n
+	tk.entries[key] = e
+	heap.Fix(&tk.heap, 0)
+}
+
+// Top returns the "k" keys with the highest counts, ordered from highest to
+// lowest.
+func (tk *TopK[K]) Top(k int) []KeyCount[K] {
+	tk.mu.Lock()
+	res := make([]KeyCount[K], len(tk.heap))
+	for i, e := range tk.heap {
+		res[i] = e.KeyCount
+	}
+	tk.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Count > res[j].Count
+	})
+	if k >= 0 && k < len(res) {
+		res = res[:k]
+	}
+	return res
+}
+
+// Reset removes all monitored keys.
+func (tk *TopK[K]) Reset() {
+	tk.mu.Lock()
+	clear(tk.entries)
+	tk.heap = tk.heap[:0]
+	tk.mu.Unlock()
+}
+
+// keyTracker tracks the heaviest keys of a limiter, by volume and by denials.
+type keyTracker[K comparable] struct {
+	// volume tracks the keys by requested count
+	volume *TopK[K]
+	// denials tracks the keys by denied count
+	denials *TopK[K]
+}
+
+// newKeyTracker returns a keyTracker monitoring at most "capacity" keys each.
+func newKeyTracker[K comparable](capacity int) *keyTracker[K] {
+	return &keyTracker[K]{
+		volume:  NewTopK[K](capacity),
+		denials: NewTopK[K](capacity),
+	}
+}
+
+// observe records a request of "n" for "key", and whether it was allowed.
+func (kt *keyTracker[K]) observe(key K, n int64, allowed bool) {
+	if kt == nil || n < 1 {
+		return
+	}
+	kt.volume.Observe(key, n)
+	if !allowed {
+		kt.denials.Observe(key, n)
+	}
+}
+
+// reset starts a new window.
+func (kt *keyTracker[K]) reset() {
+	if kt == nil {
+		return
+	}
+	kt.volume.Reset()
+	kt.denials.Reset()
+}
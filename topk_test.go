@@ -0,0 +1,97 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelim
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTopKHeavyHitters(t *testing.T) {
+	tk := NewTopK[string](10)
+	for i := 0; i < 1000; i++ {
+		// a stream of unique keys, interleaved with two heavy hitters
+		tk.Observe("key"+strconv.Itoa(i), 1)
+		if i%3 == 0 {
+			tk.Observe("heavy1", 1)
+		}
+		if i%5 == 0 {
+			tk.Observe("heavy2", 1)
+		}
+	}
+	top := tk.Top(2)
+	if len(top) != 2 {
+		t.Fatal("Incorrect number of top keys:", len(top))
+	}
+	if top[0].Key != "heavy1" || top[1].Key != "heavy2" {
+		t.Error("Incorrect top keys:", top)
+	}
+	for _, kc := range top {
+		if kc.Count-kc.Error > 334 || kc.Count < 200 {
+			t.Error("Incorrect count bounds:", kc)
+		}
+	}
+	if len(tk.Top(-1)) != 10 {
+		t.Error("Top should be bounded by the capacity")
+	}
+	tk.Reset()
+	if len(tk.Top(10)) != 0 {
+		t.Error("Reset should remove all keys")
+	}
+}
+
+func TestLimiterTopKeys(t *testing.T) {
+	lim := NewLimiter(5, time.Second)
+	defer lim.Close()
+	if lim.TopKeys(1) != nil {
+		t.Error("TopKeys should be nil before tracking is enabled")
+	}
+	lim.TrackTopKeys(8)
+	for i := 0; i < 10; i++ {
+		lim.Inc("sample1")
+	}
+	lim.Inc("sample2")
+	top := lim.TopKeys(2)
+	if len(top) != 2 || top[0].Key != "sample1" || top[0].Count != 10 {
+		t.Error("Incorrect top keys:", top)
+	}
+	denied := lim.TopDenied(2)
+	if len(denied) != 1 || denied[0].Key != "sample1" || denied[0].Count != 5 {
+		t.Error("Incorrect top denied keys:", denied)
+	}
+}
+
+func TestShardedLimiterTopKeys(t *testing.T) {
+	lim := NewShardedLimiter(1, time.Second)
+	defer lim.Close()
+	lim.TrackTopKeys(8)
+	lim.Inc("sample1")
+	lim.Inc("sample1")
+	if top := lim.TopKeys(1); len(top) != 1 || top[0].Count != 2 {
+		t.Error("Incorrect top keys:", top)
+	}
+	if denied := lim.TopDenied(1); len(denied) != 1 || denied[0].Count != 1 {
+		t.Error("Incorrect top denied keys:", denied)
+	}
+}